@@ -0,0 +1,237 @@
+/*
+ * Package ast defines the tree that messages are parsed into, along with the
+ * other information returned by a parse.
+ */
+package ast
+
+import (
+	"fmt"
+	"github.com/moechat/parser/token"
+	"strings"
+)
+
+// The kinds of Node
+type Kind int
+
+const (
+	// The root of a tree
+	DocumentNode Kind = iota
+	// Text that isn't part of any markup
+	TextNode
+	// A tag, i.e. [b]...[/b]
+	ElementNode
+)
+
+func (k Kind) String() string {
+	switch k {
+	case DocumentNode:
+		return "document"
+	case TextNode:
+		return "text"
+	case ElementNode:
+		return "element"
+	}
+	return fmt.Sprintf("Kind(%d)", int(k))
+}
+
+// A Node is a single node of a parsed message.
+type Node struct {
+	Kind     Kind
+	Name     string     // The name of the tag, for ElementNodes
+	Args     []string   // The arguments of the tag, for ElementNodes
+	Text     string     // The (unescaped) text, for TextNodes
+	Children []*Node    // The body of the tag, for ElementNodes and DocumentNodes
+	Span     token.Span // The part of the input this node was parsed from, including any tags
+	Pending  bool       // Whether the element's closing tag is still missing from a preview, so it only holds its opening tag's text
+}
+
+// NewText returns a TextNode.
+func NewText(text string, span token.Span) *Node {
+	return &Node{Kind: TextNode, Text: text, Span: span}
+}
+
+// NewElement returns an ElementNode with no children.
+func NewElement(name string, args []string, span token.Span) *Node {
+	return &Node{Kind: ElementNode, Name: name, Args: args, Span: span}
+}
+
+// Arg returns the i'th argument of n, or "" if there is no such argument.
+func (n *Node) Arg(i int) string {
+	if i < len(n.Args) {
+		return n.Args[i]
+	}
+	return ""
+}
+
+// AppendText adds text to the end of n's children, merging it into the last
+// child if that is a TextNode that ends where span starts.
+func (n *Node) AppendText(text string, span token.Span) {
+	if text == "" {
+		return
+	}
+	if last := n.LastChild(); last != nil && last.Kind == TextNode && last.Span.End == span.Start {
+		last.Text += text
+		last.Span.End = span.End
+		return
+	}
+	n.Children = append(n.Children, NewText(text, span))
+}
+
+// LastChild returns the last child of n, or nil if it has none.
+func (n *Node) LastChild() *Node {
+	if len(n.Children) == 0 {
+		return nil
+	}
+	return n.Children[len(n.Children)-1]
+}
+
+// Walk calls f for n and all of its descendants, in document order.
+// If f returns false, the children of that node are skipped.
+func (n *Node) Walk(f func(*Node) bool) {
+	if !f(n) {
+		return
+	}
+	for _, c := range n.Children {
+		c.Walk(f)
+	}
+}
+
+// Tokens flattens n into a token stream. Elements with no children become a
+// single token.SingleToken, and other elements are surrounded by an open and a close token.
+func (n *Node) Tokens() []token.Token {
+	ret := make([]token.Token, 0)
+	switch n.Kind {
+	case TextNode:
+		t := token.NewTextToken(n.Text)
+		t.Span = n.Span
+		return append(ret, t)
+	case ElementNode:
+		if len(n.Children) == 0 {
+			t := token.NewTagToken(token.SingleToken, n.Name, n.Args)
+			t.Span = n.Span
+			return append(ret, t)
+		}
+		t := token.NewTagToken(token.OpenToken, n.Name, n.Args)
+		t.Span = token.Span{Start: n.Span.Start, End: n.Children[0].Span.Start}
+		ret = append(ret, t)
+	}
+	for _, c := range n.Children {
+		ret = append(ret, c.Tokens()...)
+	}
+	if n.Kind == ElementNode {
+		t := token.NewTagToken(token.CloseToken, n.Name, nil)
+		t.Span = token.Span{Start: n.LastChild().Span.End, End: n.Span.End}
+		ret = append(ret, t)
+	}
+	return ret
+}
+
+// A Diagnostic is a problem found while parsing, i.e. a tag that was never closed.
+// The parser recovers from all of these, but they can point at mistakes in the input.
+type Diagnostic struct {
+	Span token.Span
+	Msg  string
+}
+
+func (d Diagnostic) String() string {
+	return fmt.Sprintf("%d-%d: %s", d.Span.Start, d.Span.End, d.Msg)
+}
+
+// The kinds of Link
+type LinkKind int
+
+const (
+	// A link that can be followed, i.e. <a href>
+	Hyperlink LinkKind = iota
+	// An image that is shown inline, i.e. <img src>
+	Image
+	// Embedded media, i.e. an <iframe>, <video> or <audio>
+	Media
+)
+
+func (k LinkKind) String() string {
+	switch k {
+	case Hyperlink:
+		return "link"
+	case Image:
+		return "image"
+	case Media:
+		return "media"
+	}
+	return fmt.Sprintf("LinkKind(%d)", int(k))
+}
+
+// A Link is a URL that a message renders as a link or embeds.
+type Link struct {
+	URL  string
+	Kind LinkKind
+	Span token.Span // The span of the element with the URL
+	Auto bool       // Whether the parser made the URL, i.e. for a #channel reference, instead of it being written in the message
+	// The URL the message loads the image from instead of URL, if it was rewritten, i.e. to go through an image proxy
+	Proxy string
+}
+
+// A Document is the result of parsing a message.
+type Document struct {
+	Input       string
+	Root        *Node
+	Diagnostics []Diagnostic
+	Channels    []string // The IDs of the channels the message refers to, in order and without duplicates
+	Links       []Link   // The URLs the message renders, in order
+}
+
+// NewDocument returns a Document with an empty root spanning all of input.
+func NewDocument(input string) *Document {
+	return &Document{
+		Input: input,
+		Root:  &Node{Kind: DocumentNode, Span: token.Span{Start: 0, End: len(input)}},
+	}
+}
+
+// Diagnose adds a Diagnostic to d.
+func (d *Document) Diagnose(span token.Span, format string, args ...interface{}) {
+	d.Diagnostics = append(d.Diagnostics, Diagnostic{span, fmt.Sprintf(format, args...)})
+}
+
+// AddChannel adds id to d.Channels unless it is already there.
+func (d *Document) AddChannel(id string) {
+	for _, c := range d.Channels {
+		if c == id {
+			return
+		}
+	}
+	d.Channels = append(d.Channels, id)
+}
+
+// Pending returns the Pending elements of d, which are the tags that would be closed
+// automatically if the previewed input was sent as it is, in the order they were opened.
+func (d *Document) Pending() []*Node {
+	var ret []*Node
+	d.Root.Walk(func(n *Node) bool {
+		if n.Pending {
+			ret = append(ret, n)
+		}
+		return true
+	})
+	return ret
+}
+
+// DiagnosticError is returned by Err when a Document has diagnostics.
+type DiagnosticError []Diagnostic
+
+func (de DiagnosticError) Error() string {
+	msgs := make([]string, len(de))
+	for i, d := range de {
+		msgs[i] = d.String()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// Err returns the diagnostics of d as an error, or nil if there are none.
+// It is meant for strict callers that want to reject any input with problems.
+func (d *Document) Err() error {
+	if len(d.Diagnostics) == 0 {
+		return nil
+	}
+	return DiagnosticError(d.Diagnostics)
+}
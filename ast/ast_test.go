@@ -0,0 +1,67 @@
+package ast_test
+
+import (
+	"."
+	"encoding/json"
+	"github.com/moechat/parser/token"
+	"reflect"
+	"testing"
+)
+
+func TestJSON(t *testing.T) {
+	doc := ast.NewDocument("[b]hi[/b]")
+	b := ast.NewElement("b", []string{"", ""}, token.Span{Start: 0, End: 9})
+	b.AppendText("hi", token.Span{Start: 3, End: 5})
+	doc.Root.Children = append(doc.Root.Children, b)
+	doc.Diagnose(token.Span{Start: 0, End: 3}, "something")
+	doc.AddChannel("1")
+	doc.AddChannel("1")
+	doc.Links = append(doc.Links, ast.Link{URL: "https://x.test/a.png", Kind: ast.Image, Span: token.Span{Start: 0, End: 9}, Proxy: "https://proxy.test/a"})
+
+	data, err := json.Marshal(doc)
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected := `{"version":1,"input":"[b]hi[/b]","root":{"kind":"document","children":[{"kind":"element","name":"b","args":["",""],"children":[{"kind":"text","text":"hi","span":[3,5]}],"span":[0,9]}],"span":[0,9]},"diagnostics":[{"span":[0,3],"message":"something"}],"channels":["1"],"links":[{"url":"https://x.test/a.png","kind":"image","span":[0,9],"proxy":"https://proxy.test/a"}]}`
+	if string(data) != expected {
+		t.Errorf("Marshalled document is %s", data)
+	}
+
+	decoded := &ast.Document{}
+	if err := json.Unmarshal(data, decoded); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(doc, decoded) {
+		t.Errorf("Document changed after a round trip: %#v", decoded)
+	}
+
+	for _, bad := range []string{
+		`{"root":{"kind":"document","span":[0,0]}}`,
+		`{"version":2,"root":{"kind":"document","span":[0,0]}}`,
+		`{"version":1,"root":{"kind":"text","span":[0,0]}}`,
+		`{"version":1,"root":{"kind":"document","children":[{"kind":"element","span":[0,0]}],"span":[0,0]}}`,
+		`{"version":1,"root":{"kind":"document","span":[3,1]}}`,
+		`{"version":1,"root":{"kind":"document","span":[0,0]},"links":[{"url":"x","kind":"video","span":[0,0]}]}`,
+	} {
+		if err := json.Unmarshal([]byte(bad), &ast.Document{}); err == nil {
+			t.Errorf("%s decoded without errors", bad)
+		}
+	}
+
+	tokens, err := json.Marshal(doc.Root.Tokens())
+	if err != nil {
+		t.Fatal(err)
+	}
+	expected = `[{"type":"tag","kind":"open","name":"b","args":["",""],"span":[0,3]},{"type":"text","text":"hi","span":[3,5]},{"type":"tag","kind":"close","name":"b","span":[5,9]}]`
+	if string(tokens) != expected {
+		t.Errorf("Marshalled tokens are %s", tokens)
+	}
+
+	var list token.List
+	if err := json.Unmarshal(tokens, &list); err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual([]token.Token(list), doc.Root.Tokens()) {
+		t.Errorf("Tokens changed after a round trip: %#v", list)
+	}
+}
@@ -0,0 +1,167 @@
+package ast
+
+import (
+	"encoding/json"
+	"fmt"
+	"github.com/moechat/parser/token"
+)
+
+// WireVersion is the version of the JSON encoding of Documents, which is described by schema.json.
+// It is only increased when a change would break existing decoders; new optional fields don't change it.
+const WireVersion = 1
+
+func (k Kind) MarshalText() ([]byte, error) {
+	switch k {
+	case DocumentNode, TextNode, ElementNode:
+		return []byte(k.String()), nil
+	}
+	return nil, fmt.Errorf("ast: unknown node kind %d", int(k))
+}
+
+func (k *Kind) UnmarshalText(text []byte) error {
+	for _, kind := range []Kind{DocumentNode, TextNode, ElementNode} {
+		if string(text) == kind.String() {
+			*k = kind
+			return nil
+		}
+	}
+	return fmt.Errorf("ast: unknown node kind %q", text)
+}
+
+func (k LinkKind) MarshalText() ([]byte, error) {
+	switch k {
+	case Hyperlink, Image, Media:
+		return []byte(k.String()), nil
+	}
+	return nil, fmt.Errorf("ast: unknown link kind %d", int(k))
+}
+
+func (k *LinkKind) UnmarshalText(text []byte) error {
+	for _, kind := range []LinkKind{Hyperlink, Image, Media} {
+		if string(text) == kind.String() {
+			*k = kind
+			return nil
+		}
+	}
+	return fmt.Errorf("ast: unknown link kind %q", text)
+}
+
+type jsonNode struct {
+	Kind     Kind       `json:"kind"`
+	Name     string     `json:"name,omitempty"`
+	Args     []string   `json:"args,omitempty"`
+	Text     string     `json:"text,omitempty"`
+	Children []*Node    `json:"children,omitempty"`
+	Span     token.Span `json:"span"`
+	Pending  bool       `json:"pending,omitempty"`
+}
+
+func (n *Node) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonNode(*n))
+}
+
+func (n *Node) UnmarshalJSON(data []byte) error {
+	var jn jsonNode
+	if err := json.Unmarshal(data, &jn); err != nil {
+		return err
+	}
+
+	switch {
+	case jn.Kind == ElementNode && jn.Name == "":
+		return fmt.Errorf("ast: element at %d has no name", jn.Span.Start)
+	case jn.Kind == TextNode && len(jn.Children) != 0:
+		return fmt.Errorf("ast: text at %d has children", jn.Span.Start)
+	}
+	for _, c := range jn.Children {
+		if c == nil {
+			return fmt.Errorf("ast: node at %d has a null child", jn.Span.Start)
+		}
+		if c.Kind == DocumentNode {
+			return fmt.Errorf("ast: document node nested at %d", c.Span.Start)
+		}
+	}
+
+	*n = Node(jn)
+	return nil
+}
+
+type jsonDiagnostic struct {
+	Span    token.Span `json:"span"`
+	Message string     `json:"message"`
+}
+
+type jsonDocument struct {
+	Version     int              `json:"version"`
+	Input       string           `json:"input,omitempty"`
+	Root        *Node            `json:"root"`
+	Diagnostics []jsonDiagnostic `json:"diagnostics,omitempty"`
+	Channels    []string         `json:"channels,omitempty"`
+	Links       []Link           `json:"links,omitempty"`
+}
+
+type jsonLink struct {
+	URL   string     `json:"url"`
+	Kind  LinkKind   `json:"kind"`
+	Span  token.Span `json:"span"`
+	Auto  bool       `json:"auto,omitempty"`
+	Proxy string     `json:"proxy,omitempty"`
+}
+
+func (l Link) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonLink(l))
+}
+
+func (l *Link) UnmarshalJSON(data []byte) error {
+	var jl jsonLink
+	if err := json.Unmarshal(data, &jl); err != nil {
+		return err
+	}
+	*l = Link(jl)
+	return nil
+}
+
+func (d Diagnostic) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonDiagnostic{d.Span, d.Msg})
+}
+
+func (d *Diagnostic) UnmarshalJSON(data []byte) error {
+	var jd jsonDiagnostic
+	if err := json.Unmarshal(data, &jd); err != nil {
+		return err
+	}
+	*d = Diagnostic{jd.Span, jd.Message}
+	return nil
+}
+
+// MarshalJSON encodes d in the wire format described by schema.json.
+func (d *Document) MarshalJSON() ([]byte, error) {
+	jd := jsonDocument{Version: WireVersion, Input: d.Input, Root: d.Root, Channels: d.Channels, Links: d.Links}
+	for _, diag := range d.Diagnostics {
+		jd.Diagnostics = append(jd.Diagnostics, jsonDiagnostic{diag.Span, diag.Msg})
+	}
+	return json.Marshal(jd)
+}
+
+// UnmarshalJSON decodes a Document in the wire format. Documents written with
+// a newer WireVersion are rejected, since they may not mean what they seem to.
+func (d *Document) UnmarshalJSON(data []byte) error {
+	var jd jsonDocument
+	if err := json.Unmarshal(data, &jd); err != nil {
+		return err
+	}
+
+	switch {
+	case jd.Version < 1:
+		return fmt.Errorf("ast: document has no version")
+	case jd.Version > WireVersion:
+		return fmt.Errorf("ast: document version %d is newer than %d", jd.Version, WireVersion)
+	case jd.Root == nil || jd.Root.Kind != DocumentNode:
+		return fmt.Errorf("ast: document root must be a document node")
+	}
+
+	*d = Document{Input: jd.Input, Root: jd.Root, Channels: jd.Channels, Links: jd.Links}
+	for _, diag := range jd.Diagnostics {
+		d.Diagnostics = append(d.Diagnostics, Diagnostic{diag.Span, diag.Message})
+	}
+	return nil
+}
@@ -2,142 +2,628 @@ package bbcode
 
 import (
 	"bytes"
+	"context"
+	"github.com/moechat/parser/ast"
+	"github.com/moechat/parser/grapheme"
+	"github.com/moechat/parser/media"
+	"github.com/moechat/parser/parsectx"
+	"github.com/moechat/parser/permission"
 	"github.com/moechat/parser/token"
 	"html"
 	"html/template"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 var bbCodeRe = regexp.MustCompile("\\[([^\\]|^\\[]*)\\]")
 
+// argLineRe matches the rest of the line after the opening delimiter of an ArgLine tag, i.e. "go\n" after ```
+var argLineRe = regexp.MustCompile(`^[ \t]*([A-Za-z0-9_+#.-]*)[ \t]*\r?\n`)
+
 func bbCloseTag(name string) (*regexp.Regexp, error) {
-	return regexp.Compile("\\[\\/" + name + "\\]")
+	return regexp.Compile("\\[\\/" + regexp.QuoteMeta(name) + "\\]")
 }
 
+// bbTag matches the opening tags of the tag named name, with args or named args like splitTag accepts.
 func bbTag(name string) (*regexp.Regexp, error) {
-	return regexp.Compile("\\[" + name + "(=.*)?\\]")
+	return regexp.Compile("\\[" + regexp.QuoteMeta(name) + "(?:[= ][^\\]]*)?\\]")
 }
 
-type bbTagPair struct {
-	htmlTag HtmlTags
-	bbName  string
+func closeTags(htmlTags HtmlTags, args []string) string {
+	if htmlTags.CloseFunc != nil {
+		return htmlTags.CloseFunc(args)
+	}
+
+	endTags := ""
+	if htmlTags.Tags != nil {
+		if htmlTags.Options&token.HtmlSingle == 0 {
+			for _, tag := range htmlTags.Tags {
+				endTags = "</" + tag + ">" + endTags
+			}
+		}
+	}
+	return endTags
 }
 
-type stack struct {
-	nodes []*bbTagPair
-	count int
+// sortedArgs returns the keys of m in order, so elements are always output the same way.
+func sortedArgs(m map[int8]string) []int8 {
+	keys := make([]int8, 0, len(m))
+	for i := range m {
+		keys = append(keys, i)
+	}
+	sort.Slice(keys, func(a, b int) bool { return keys[a] < keys[b] })
+	return keys
 }
 
-func (s *stack) push(n *bbTagPair) {
-	s.nodes = append(s.nodes[:s.count], n)
-	s.count++
+// openTags returns the HTML that opens the elements of htmlTags, given the tag's args.
+func openTags(htmlTags HtmlTags, args []string) (string, error) {
+	if htmlTags.OutputFunc != nil {
+		return htmlTags.OutputFunc(args), nil
+	}
+
+	output := ""
+	for i, tag := range htmlTags.Tags {
+		templStr := "<" + tag
+
+		if len(htmlTags.Classes) > i {
+			if classes := htmlTags.Classes[i]; classes != nil {
+				templStr += " class=\""
+				for _, class := range classes {
+					templStr += " " + class
+				}
+				templStr += "\""
+			}
+		}
+
+		if len(htmlTags.Attributes) > i {
+			if attrs := htmlTags.Attributes[i]; attrs != nil {
+				for _, i := range sortedArgs(attrs) {
+					if attr := attrs[i]; len(args) > int(i) && args[i] != "" {
+						templStr += " " + attr + "=\"{{index . " + strconv.Itoa(int(i)) + "}}\""
+					}
+				}
+			}
+		}
+
+		if len(htmlTags.CssProps) > i {
+			if cssProps := htmlTags.CssProps[i]; cssProps != nil {
+				templStr += " style=\""
+				for _, i := range sortedArgs(cssProps) {
+					if cssProp := cssProps[i]; len(args) > int(i) && args[i] != "" {
+						templStr += cssProp + ": {{index . " + strconv.Itoa(int(i)) + "}};"
+					}
+				}
+				templStr += "\""
+			}
+		}
+
+		templStr += ">"
+
+		tmpl, err := template.New("elementTemplate").Parse(templStr)
+		if err != nil {
+			return "", err
+		}
+
+		eleBuffer := bytes.Buffer{}
+		err = tmpl.Execute(&eleBuffer, args)
+		if err != nil {
+			return "", err
+		}
+		output += eleBuffer.String()
+	}
+	return output, nil
 }
 
-func (s *stack) pop() *bbTagPair {
-	if s.count == 0 {
-		return nil
+// The ways a Parser can render newlines
+type NewlineMode int
+
+const (
+	// Newlines are left as they are, so they need white-space: pre-wrap to show up
+	PreserveNewlines NewlineMode = iota
+	// Every newline becomes a <br>
+	BreakNewlines
+	// The message is split into <p>s at blank lines, and the other newlines become <br>s.
+	// Block tags at the top level are kept out of the paragraphs. RenderTokens treats this like BreakNewlines.
+	Paragraphs
+)
+
+// The ways a Parser can repair misnested tags, i.e. [b][i]x[/b]y[/i]
+type MisnestMode int
+
+const (
+	// The tags opened inside the closed one are closed with it, so the example becomes
+	// <b><i>x</i></b>y[/i]
+	CloseMisnested MisnestMode = iota
+	// Like HTML's adoption agency algorithm, the inline tags opened inside the closed one are
+	// closed with it and then reopened after it, so the example becomes <b><i>x</i></b><i>y</i>
+	ReopenMisnested
+)
+
+// String returns the name of m, like moeparse's -newlines flag.
+func (m NewlineMode) String() string {
+	switch m {
+	case PreserveNewlines:
+		return "preserve"
+	case BreakNewlines:
+		return "br"
+	case Paragraphs:
+		return "p"
 	}
-	s.count--
-	return s.nodes[s.count]
+	return "NewlineMode(" + strconv.Itoa(int(m)) + ")"
 }
 
-func (s *stack) top() *bbTagPair {
-	if s.count == 0 {
-		return nil
+// String returns the name of m, like moeparse's -misnesting flag.
+func (m MisnestMode) String() string {
+	switch m {
+	case CloseMisnested:
+		return "close"
+	case ReopenMisnested:
+		return "reopen"
 	}
-	return s.nodes[s.count-1]
+	return "MisnestMode(" + strconv.Itoa(int(m)) + ")"
+}
+
+// A ChannelResolver returns the ID and URL of the channel named name, or false if there is no such channel.
+// ctx is the context the message is parsed in; see the parsectx package.
+type ChannelResolver func(ctx context.Context, name string) (id, url string, ok bool)
+
+// A Parser converts BBCode to HTML using a set of tags.
+type Parser struct {
+	tags  map[string]HtmlTags
+	tagRe *regexp.Regexp // Matches BBCode tags and the delimiters of Symmetric tags
+
+	// If set, Parse returns the error from CheckOutput instead of any HTML it rejects.
+	// htmlcheck.Check is meant to be used here.
+	CheckOutput func(html string) error
+
+	// Returns the URL of the message with the given ID, or "" if there is no such message.
+	// This is used to link to the source of a [quote msg=id].
+	MessageURL func(ctx context.Context, id string) string
+
+	// If set, #channel references to the channels it knows are linked, and their IDs are added
+	// to Document.Channels. Unknown channels are left as text.
+	ResolveChannel ChannelResolver
+
+	// The character that makes the tag or delimiter after it literal, i.e. \[b]; NewParser sets it
+	// to \. Two of them are a literal one, and one before anything else is left alone. The bodies
+	// of tags that aren't parsed, like [code], can't have escapes. If it is 0, nothing can be escaped.
+	EscapeChar rune
+
+	// How tags closed by a tag they were opened inside of are repaired
+	Misnesting MisnestMode
+
+	// If set, the input is parsed as a preview of a message that is still being typed. Tags that
+	// are still open at the end of the input become Pending elements holding the text of their
+	// opening tags, which are rendered as <span class="pending">, instead of being closed there.
+	Preview bool
+
+	// If set, the URLs of [img]s are replaced with what it returns, i.e. to load them through an image
+	// proxy, which imageproxy.Proxy's RewriteImage method does. Document.Links keeps the
+	// original URLs, with the rewritten ones as their Proxy.
+	RewriteImage func(ctx context.Context, url string) string
+
+	// The providers whose media may be embedded by [youtube], [video] and [audio].
+	// If nil, media.Providers is used.
+	Providers []*media.Provider
+
+	// How newlines outside of tags with KeepNewlines are rendered
+	Newlines NewlineMode
+	// If positive, runs of more than MaxBlankLines blank lines are collapsed into MaxBlankLines
+	MaxBlankLines int
+
+	// If set, the bodies of Code tags are rendered with Highlight instead of being escaped.
+	// It returns false if it doesn't know the language, and the body is escaped as usual.
+	// highlight.HTML is meant to be used here.
+	Highlight func(lang, code string) (html string, ok bool)
 }
 
-func (s *stack) topFromN(n int) *stack {
-	return &stack{nodes: s.nodes[n:], count: len(s.nodes) - n}
+// NewParser returns a Parser that recognizes the tags in tags, keyed by their BBCode name.
+// Symmetric tags added to tags after this is called aren't recognized.
+func NewParser(tags map[string]HtmlTags) *Parser {
+	return &Parser{tags: tags, tagRe: tagRegexp(tags), EscapeChar: '\\'}
 }
 
-func closeNTags(tagPairStack *stack, n int) string {
-	endTags := ""
-	for i := 0; i < n; i++ {
-		tagPair := tagPairStack.pop()
-		endTags += closeTags(tagPair)
+// tagRegexp returns a regexp that matches bbCodeRe or the delimiter of any Symmetric tag in tags.
+func tagRegexp(tags map[string]HtmlTags) *regexp.Regexp {
+	var delims []string
+	for name, htmlTags := range tags {
+		if htmlTags.Symmetric {
+			delims = append(delims, name)
+		}
+	}
+	if len(delims) == 0 {
+		return bbCodeRe
 	}
-	return endTags
-}
 
-func closeTags(tagPair *bbTagPair) string {
-	endTags := ""
-	if tagPair.htmlTag.Tags != nil {
-		if tagPair.htmlTag.Options&token.HtmlSingle == 0 {
-			for _, tag := range tagPair.htmlTag.Tags {
-				endTags = "</" + tag + ">" + endTags
-			}
+	// Longer delimiters go first, since the first alternative that matches is used
+	sort.Slice(delims, func(a, b int) bool {
+		if len(delims[a]) != len(delims[b]) {
+			return len(delims[a]) > len(delims[b])
 		}
+		return delims[a] < delims[b]
+	})
+	expr := bbCodeRe.String()
+	for _, delim := range delims {
+		expr += "|" + regexp.QuoteMeta(delim)
 	}
-	return endTags
+	return regexp.MustCompile(expr)
 }
 
+var defaultParser = NewParser(bbCodeTags)
+
 // Parse parses BBCode only.
 // Although not used by the main Parse method, it is included in case parsing only BBCode is desired.
 // Note that this function completely ignores MoeTags.
 func Parse(body string) (string, error) {
-	tagStack := &stack{nodes: make([]*bbTagPair, 10)}
-	output := ""
-	body = html.EscapeString(body)
+	return defaultParser.Parse(body)
+}
+
+// ParseWith parses BBCode like Parse, using only the tags perms allows.
+func ParseWith(body string, perms *permission.Set) (string, error) {
+	return defaultParser.ParseWith(body, perms)
+}
+
+// ParseContext parses BBCode like Parse in ctx. See Parser.ParseDocumentContext.
+func ParseContext(ctx context.Context, body string) (string, error) {
+	return defaultParser.ParseContext(ctx, body)
+}
+
+// ParseDocument parses body into a tree using the default tags.
+func ParseDocument(body string) (*ast.Document, error) {
+	return defaultParser.ParseDocument(body)
+}
+
+// Parse parses body using p's tags. See the Parse function for details.
+func (p *Parser) Parse(body string) (string, error) {
+	return p.ParseWith(body, nil)
+}
+
+// ParseWith parses body like Parse, using only the tags perms allows. See ParseDocumentWith.
+func (p *Parser) ParseWith(body string, perms *permission.Set) (string, error) {
+	return p.ParseContext(parsectx.WithPermissions(context.Background(), perms), body)
+}
+
+// ParseContext parses body like Parse in ctx. See ParseDocumentContext.
+func (p *Parser) ParseContext(ctx context.Context, body string) (string, error) {
+	doc, err := p.ParseDocumentContext(ctx, body)
+	if err != nil {
+		return "", err
+	}
+	out, err := p.RenderHTML(doc.Root)
+	if err == nil && p.CheckOutput != nil {
+		err = p.CheckOutput(out)
+	}
+	if err != nil {
+		return "", err
+	}
+	return out, nil
+}
+
+// find returns the location of the first match of re in body at or after start, relative to the start of body.
+func find(re *regexp.Regexp, body string, start int) []int {
+	loc := re.FindStringIndex(body[start:])
+	if loc != nil {
+		loc[0] += start
+		loc[1] += start
+	}
+	return loc
+}
+
+// splitTag splits the inside of a tag, i.e. "color=red" or `quote name="x" msg=1`, into its name
+// and args. The second form may only be used with named args from the tag's NamedArgs.
+func (p *Parser) splitTag(inner string) (name string, args []string, ok bool) {
+	args = make([]string, 2)
+	tagData := strings.SplitN(inner, "=", 2)
+	space := strings.IndexByte(tagData[0], ' ')
+	if space < 0 {
+		if len(tagData) == 2 {
+			args[0] = tagData[1]
+		}
+		return tagData[0], args, true
+	}
+
+	name = inner[:space]
+	namedArgs := p.tags[name].NamedArgs
+	for rest := strings.TrimLeft(inner[space:], " "); rest != ""; rest = strings.TrimLeft(rest, " ") {
+		eq := strings.IndexByte(rest, '=')
+		if eq < 0 {
+			return name, nil, false
+		}
+		i, known := namedArgs[rest[:eq]]
+		if !known {
+			return name, nil, false
+		}
+		rest = rest[eq+1:]
+
+		var value string
+		if rest != "" && (rest[0] == '"' || rest[0] == '\'') {
+			end := strings.IndexByte(rest[1:], rest[0])
+			if end < 0 {
+				return name, nil, false
+			}
+			value, rest = rest[1:end+1], rest[end+2:]
+		} else if end := strings.IndexByte(rest, ' '); end >= 0 {
+			value, rest = rest[:end], rest[end:]
+		} else {
+			value, rest = rest, ""
+		}
+
+		for len(args) <= int(i) {
+			args = append(args, "")
+		}
+		args[i] = value
+	}
+	return name, args, true
+}
+
+// ParseDocument parses body into a tree of ast.Nodes using p's tags.
+// Tags that are closed out of order close every tag opened after them, and closing
+// tags that don't match any open tag are left as text; both are reported as diagnostics.
+func (p *Parser) ParseDocument(body string) (*ast.Document, error) {
+	return p.ParseDocumentWith(body, nil)
+}
+
+// ParseDocumentWith parses body like ParseDocument, using only the tags perms allows. The tags it
+// denies are left as text or stripped, depending on perms.Denied, and reported as diagnostics.
+// The text inside them is parsed as if they weren't there.
+func (p *Parser) ParseDocumentWith(body string, perms *permission.Set) (*ast.Document, error) {
+	return p.ParseDocumentContext(parsectx.WithPermissions(context.Background(), perms), body)
+}
 
-	for body != "" {
-		tagLoc := bbCodeRe.FindIndex([]byte(body))
+// ParseDocumentContext parses body like ParseDocument in ctx. Only the tags parsectx.Permissions(ctx)
+// allows are used, like ParseDocumentWith, and ctx is passed to p's resolvers and the tags'
+// ResolveFuncs with p's settings added as parsectx.Options, so they can use the message's author
+// and room and how it is rendered. If ctx is done before body has been parsed, its error is returned.
+func (p *Parser) ParseDocumentContext(ctx context.Context, body string) (*ast.Document, error) {
+	ctx = parsectx.WithOptions(ctx, parsectx.Options{
+		Newlines:      p.Newlines.String(),
+		MaxBlankLines: p.MaxBlankLines,
+		Misnesting:    p.Misnesting.String(),
+		Preview:       p.Preview,
+		EscapeChar:    p.EscapeChar,
+	})
+	perms := parsectx.Permissions(ctx)
+	doc := ast.NewDocument(body)
+	stack := []*ast.Node{doc.Root}
+	openTagSpans := []token.Span{{}} // The span of the opening tag of each node in stack
+	top := func() *ast.Node { return stack[len(stack)-1] }
+	text := func(start, end int) {
+		top().AppendText(body[start:end], token.Span{Start: start, End: end})
+	}
+	esc := ""
+	if p.EscapeChar != 0 {
+		esc = string(p.EscapeChar)
+	}
+	// plain adds the text between start and end, which comes right before a tag or the end of the input.
+	// Pairs of escape characters become one, and if there is one left at the end, it is dropped
+	// and plain returns true, since the tag after it is escaped.
+	plain := func(start, end int) bool {
+		for esc != "" {
+			i := strings.Index(body[start:end], esc)
+			if i < 0 {
+				break
+			}
+			i += start
+			switch after := i + len(esc); {
+			case after == end:
+				text(start, i)
+				return true
+			case strings.HasPrefix(body[after:end], esc):
+				text(start, i)
+				top().AppendText(esc, token.Span{Start: i, End: after + len(esc)})
+				start = after + len(esc)
+			default:
+				// An escape character that isn't escaping anything is just text
+				text(start, after)
+				start = after
+			}
+		}
+		text(start, end)
+		return false
+	}
+	reopened := make(map[*ast.Node]bool) // The copies of misnested elements opened by ReopenMisnested
+	// pop closes the top of the stack at end. Reopened elements that are closed before getting
+	// any children are dropped.
+	pop := func(end int) {
+		n := top()
+		n.Span.End = end
+		stack = stack[:len(stack)-1]
+		openTagSpans = openTagSpans[:len(stack)]
+		if reopened[n] && len(n.Children) == 0 {
+			top().Children = top().Children[:len(top().Children)-1]
+		}
+	}
+	// reopens returns whether n should be reopened if it is closed by a misnested tag.
+	reopens := func(n *ast.Node) bool {
+		htmlTags := p.tags[n.Name]
+		return p.Misnesting == ReopenMisnested && !htmlTags.Block && htmlTags.Parents == nil
+	}
+	// reopen opens copies of closed, which are listed innermost first, at pos.
+	reopen := func(closed []*ast.Node, pos int) {
+		for i := len(closed) - 1; i >= 0; i-- {
+			n := ast.NewElement(closed[i].Name, closed[i].Args, token.Span{Start: pos, End: pos})
+			reopened[n] = true
+			top().Children = append(top().Children, n)
+			stack = append(stack, n)
+			openTagSpans = append(openTagSpans, n.Span)
+		}
+	}
+	// closeTo closes stack[match] and every node opened inside it with the tag at closeSpan.
+	closeTo := func(match int, closeSpan token.Span) {
+		closer := body[closeSpan.Start:closeSpan.End]
+		var closed []*ast.Node
+		for len(stack) > match {
+			switch n := top(); {
+			case len(stack)-1 == match:
+			case reopens(n):
+				doc.Diagnose(closeSpan, "%s closes [%s], which was opened inside it, so [%s] was reopened after it", closer, n.Name, n.Name)
+				closed = append(closed, n)
+			case p.tags[n.Name].Parents == nil:
+				doc.Diagnose(closeSpan, "%s closes [%s], which was opened inside it", closer, n.Name)
+			}
+			pop(closeSpan.End)
+		}
+		reopen(closed, closeSpan.End)
+	}
 
+	tagRe := p.tagRe
+	if tagRe == nil {
+		tagRe = bbCodeRe
+	}
+
+	stripped := make(map[int]bool) // The offsets of the closing delimiters of stripped Symmetric tags
+
+	pos := 0
+	for pos < len(body) {
+		if err := ctx.Err(); err != nil {
+			return nil, err
+		}
+		tagLoc := find(tagRe, body, pos)
 		if tagLoc == nil {
-			output += body
-			body = ""
 			break
 		}
+		tagSpan := token.Span{Start: tagLoc[0], End: tagLoc[1]}
+		if plain(pos, tagLoc[0]) {
+			top().AppendText(body[tagLoc[0]:tagLoc[1]], token.Span{Start: tagLoc[0] - len(esc), End: tagLoc[1]})
+			pos = tagLoc[1]
+			continue
+		}
+		pos = tagLoc[0]
+
+		if delim := body[tagLoc[0]:tagLoc[1]]; p.tags[delim].Symmetric {
+			htmlTags := p.tags[delim]
+			text(pos, tagLoc[0])
+			pos = tagLoc[1]
+
+			if !p.allows(perms, delim) {
+				switch end := p.closingDelim(htmlTags, delim, body, pos); {
+				case stripped[tagLoc[0]]:
+					// The closing delimiter of a stripped one
+				case end < 0:
+					text(tagLoc[0], pos)
+				case perms.Strips():
+					doc.Diagnose(tagSpan, "%s isn't allowed", delim)
+					stripped[pos+end] = true
+				default:
+					doc.Diagnose(tagSpan, "%s isn't allowed", delim)
+					text(tagLoc[0], pos)
+				}
+				continue
+			}
+
+			match := innermost(stack, []string{delim})
+			end := p.closingDelim(htmlTags, delim, body, pos)
+			switch {
+			case match != 0:
+				closeTo(match, tagSpan)
+			case end < 0:
+				// A delimiter that is never closed is just text, i.e. "a || b"
+				text(tagLoc[0], pos)
+			default:
+				args := make([]string, 2)
+				if loc := argLineRe.FindStringSubmatchIndex(body[pos:]); htmlTags.ArgLine && loc != nil {
+					args[0] = body[pos+loc[2] : pos+loc[3]]
+					pos, end = pos+loc[1], end-loc[1]
+				}
+				node := ast.NewElement(delim, args, tagSpan)
+				top().Children = append(top().Children, node)
 
-		tagData := strings.SplitN(body[tagLoc[0]+1:tagLoc[1]-1], "=", 2)
-		htmlTags, ok := bbCodeTags[tagData[0]]
+				if htmlTags.Options&token.NoParseInner != 0 {
+					inner := body[pos : pos+end]
+					if htmlTags.ArgLine {
+						inner = strings.TrimSuffix(inner, "\n")
+					}
+					node.AppendText(inner, token.Span{Start: pos, End: pos + len(inner)})
+					pos += end + len(delim)
+					node.Span.End = pos
+				} else {
+					stack = append(stack, node)
+					openTagSpans = append(openTagSpans, tagSpan)
+				}
+			}
+			continue
+		}
+
+		name, args, argsOk := p.splitTag(body[tagLoc[0]+1 : tagLoc[1]-1])
+		htmlTags, ok := p.tags[name]
+		ok = ok && argsOk
 		cok := false
-		if tagData[0][0] == '/' {
-			_, cok = bbCodeTags[tagData[0][1:]]
+		if strings.HasPrefix(name, "/") {
+			_, cok = p.tags[name[1:]]
+		}
+
+		parent := 0
+		if ok && htmlTags.Parents != nil {
+			parent = innermost(stack, htmlTags.Parents)
+			ok = parent != 0
+		}
+
+		if ok && !p.allows(perms, name) || cok && !p.allows(perms, name[1:]) {
+			doc.Diagnose(tagSpan, "[%s] isn't allowed", name)
+			ok, cok = false, false
+			if perms.Strips() {
+				text(pos, tagLoc[0])
+				pos = tagLoc[1]
+				continue
+			}
 		}
 
 		if ok {
-			output += body[:tagLoc[0]]
-			body = body[tagLoc[1]:]
+			text(pos, tagLoc[0])
+			pos = tagLoc[1]
+
+			var closed []*ast.Node // The misnested elements to reopen after the tag
+			for parent != 0 && len(stack)-1 > parent {
+				switch n := top(); {
+				case reopens(n):
+					doc.Diagnose(tagSpan, "[%s] closes [%s], so [%s] was reopened after it", name, n.Name, n.Name)
+					closed = append(closed, n)
+				case p.tags[n.Name].Parents == nil:
+					doc.Diagnose(tagSpan, "[%s] closes [%s]", name, n.Name)
+				}
+				pop(tagLoc[0])
+			}
+
+			if htmlTags.NotInLinks && p.inLink(stack) {
+				doc.Diagnose(tagSpan, "[%s] can't be inside a link", name)
+				text(tagLoc[0], pos)
+				reopen(closed, pos)
+				continue
+			}
 
-			args := make([]string, 2)
-			if len(tagData) == 2 {
-				args[0] = tagData[1]
+			closeTagRe, err := bbCloseTag(name)
+			if err != nil {
+				return nil, err
 			}
+			tagRe, err := bbTag(name)
+			if err != nil {
+				return nil, err
+			}
+			closeTagLoc := p.findTag(htmlTags, closeTagRe, body, pos)
 
+			// Whether the tag's body was consumed as an argument
+			bodyIsArg := false
 			if htmlTags.Options&(token.TokenBodyAsArg|token.AllowTokenBodyAsFirstArg) != 0 {
-				closeTagRe, err := bbCloseTag(tagData[0])
-				if err != nil {
-					return "", err
+				bodyEnd, afterClose := len(body), len(body)
+				useBody := htmlTags.Options&token.PossibleSingle == 0
+				if closeTagLoc != nil {
+					bodyEnd, afterClose = closeTagLoc[0], closeTagLoc[1]
+					openTagLoc := p.findTag(htmlTags, tagRe, body, pos)
+					useBody = useBody || openTagLoc == nil || closeTagLoc[0] < openTagLoc[0]
 				}
-				closeTagLoc := closeTagRe.FindIndex([]byte(body))
-				if closeTagLoc == nil {
-					if htmlTags.Options&token.PossibleSingle == 0 {
-						if htmlTags.Options&token.AllowTokenBodyAsFirstArg != 0 && args[0] == "" {
-							args[0] = body[tagLoc[1]:]
-						}
-						if htmlTags.Options&token.TokenBodyAsArg != 0 {
-							args[1] = body[tagLoc[1]:]
-							body = ""
-						}
-					}
-				} else {
-					tagRe, err := bbTag(tagData[0])
-					if err != nil {
-						return "", err
+
+				if useBody {
+					if htmlTags.Options&token.AllowTokenBodyAsFirstArg != 0 && args[0] == "" {
+						args[0] = body[pos:bodyEnd]
 					}
-					openTagLoc := tagRe.FindIndex([]byte(body))
-					if htmlTags.Options&token.PossibleSingle == 0 || openTagLoc == nil || closeTagLoc[0] < openTagLoc[0] {
-						if htmlTags.Options&token.AllowTokenBodyAsFirstArg != 0 && args[0] == "" {
-							args[0] = body[:closeTagLoc[0]]
-						}
-						if htmlTags.Options&token.TokenBodyAsArg != 0 {
-							args[1] = body[:closeTagLoc[0]]
-							body = body[closeTagLoc[1]:]
-						}
+					if htmlTags.Options&token.TokenBodyAsArg != 0 {
+						args[1] = body[pos:bodyEnd]
+						bodyIsArg = true
+						pos = afterClose
 					}
 				}
 			}
@@ -145,124 +631,734 @@ func Parse(body string) (string, error) {
 			if htmlTags.InputModFunc != nil {
 				htmlTags.InputModFunc(&args)
 			}
+			if htmlTags.ResolveFunc != nil {
+				htmlTags.ResolveFunc(ctx, p, &args)
+			}
 
-			if htmlTags.OutputFunc != nil {
-				output += htmlTags.OutputFunc(args)
-			} else {
-				for i, tag := range htmlTags.Tags {
-					templStr := "<" + tag
-
-					if len(htmlTags.Classes) > i {
-						if classes := htmlTags.Classes[i]; classes != nil {
-							templStr += " class=\""
-							for _, class := range classes {
-								templStr += " " + class
-							}
-							templStr += "\""
-						}
-					}
+			if htmlTags.ArgValidFunc != nil && !htmlTags.ArgValidFunc(args) {
+				doc.Diagnose(tagSpan, "invalid arguments for [%s]", name)
+				pos = tagLoc[1]
+				text(tagLoc[0], pos)
+				reopen(closed, pos)
+				continue
+			}
 
-					if len(htmlTags.Attributes) > i {
-						if attrs := htmlTags.Attributes[i]; attrs != nil {
-							for i, attr := range attrs {
-								if len(args) > int(i) && args[i] != "" {
-									templStr += " " + attr + "=\"{{index . " + strconv.Itoa(int(i)) + "}}\""
-								}
-							}
-						}
-					}
+			node := ast.NewElement(name, args, token.Span{Start: tagLoc[0], End: pos})
+			top().Children = append(top().Children, node)
+
+			single := htmlTags.Options&token.PossibleSingle != 0
+			if single && closeTagLoc != nil {
+				// The tag is only single if the next closing tag belongs to another tag with the same name
+				openTagLoc := p.findTag(htmlTags, tagRe, body, pos)
+				single = openTagLoc != nil && openTagLoc[0] < closeTagLoc[0]
+			}
 
-					if len(htmlTags.CssProps) > i {
-						if cssProps := htmlTags.CssProps[i]; cssProps != nil {
-							templStr += " style=\""
-							for i, cssProp := range cssProps {
-								if len(args) > int(i) && args[i] != "" {
-									templStr += cssProp + ": {{index . " + strconv.Itoa(int(i)) + "}};"
-								}
-							}
-							templStr += "\""
-						}
+			switch {
+			case bodyIsArg || single || htmlTags.Options&token.HtmlSingle != 0:
+				// The tag has no body
+			case htmlTags.Options&token.NoParseInner != 0:
+				if closeTagLoc == nil {
+					doc.Diagnose(tagSpan, "[%s] is never closed", name)
+					node.AppendText(body[pos:], token.Span{Start: pos, End: len(body)})
+					pos = len(body)
+					if p.Preview {
+						node.Span.End = pos
+						p.pend(body, tagRe, top(), len(top().Children)-1)
 					}
+				} else {
+					node.AppendText(body[pos:closeTagLoc[0]], token.Span{Start: pos, End: closeTagLoc[0]})
+					pos = closeTagLoc[1]
+				}
+				node.Span.End = pos
+			default:
+				stack = append(stack, node)
+				openTagSpans = append(openTagSpans, tagSpan)
+			}
+			reopen(closed, pos)
+		} else if cok {
+			match := 0
+			for i := len(stack) - 1; i > 0; i-- {
+				if stack[i].Name == name[1:] {
+					match = i
+					break
+				}
+			}
 
-					templStr += ">"
+			if match != 0 {
+				text(pos, tagLoc[0])
+				closeTo(match, tagSpan)
+			} else {
+				doc.Diagnose(tagSpan, "[%s] doesn't close any tag", name)
+				text(pos, tagLoc[1])
+			}
+			pos = tagLoc[1]
+		} else {
+			text(pos, tagLoc[1])
+			pos = tagLoc[1]
+		}
+	}
+	if plain(pos, len(body)) {
+		text(len(body)-len(esc), len(body))
+	}
 
-					tmpl, err := template.New("elementTemplate").Parse(templStr)
-					if err != nil {
-						return "", err
-					}
+	for len(stack) > 1 {
+		n := top()
+		if p.tags[n.Name].Parents == nil {
+			doc.Diagnose(openTagSpans[len(stack)-1], "[%s] is never closed", n.Name)
+		}
+		pop(len(body))
+		if p.Preview && top().LastChild() == n {
+			p.pend(body, tagRe, top(), len(top().Children)-1)
+		}
+	}
 
-					eleBuffer := bytes.Buffer{}
-					err = tmpl.Execute(&eleBuffer, args)
-					if err != nil {
-						return "", err
-					}
-					output += eleBuffer.String()
-				}
+	p.fixChildren(doc, doc.Root, make(map[string]int))
+	p.hoistBlocks(doc, doc.Root)
+	if p.ResolveChannel != nil {
+		p.linkChannels(ctx, doc, doc.Root)
+	}
+	p.addLinks(doc, doc.Root)
+	return doc, nil
+}
+
+// pend replaces parent.Children[i], an element that was never closed, with a Pending element holding
+// the text of its opening tag, followed by its children. The children that could only be inside it,
+// like the [*]s of a [list], are pended too.
+func (p *Parser) pend(body string, tagRe *regexp.Regexp, parent *ast.Node, i int) {
+	n := parent.Children[i]
+	span := token.Span{Start: n.Span.Start, End: n.Span.Start}
+	// Elements reopened by ReopenMisnested don't have an opening tag of their own
+	if loc := find(tagRe, body, n.Span.Start); loc != nil && loc[0] == n.Span.Start &&
+		(len(n.Children) == 0 || loc[1] <= n.Children[0].Span.Start) {
+		span.End = loc[1]
+	}
+	pending := ast.NewElement(n.Name, n.Args, span)
+	pending.Pending = true
+	pending.AppendText(body[span.Start:span.End], span)
+
+	nodes := append([]*ast.Node{pending}, n.Children...)
+	parent.Children = append(parent.Children[:i], append(nodes, parent.Children[i+1:]...)...)
+	// Backwards, so pending a child doesn't move the ones before it
+	for j := len(nodes) - 1; j > 0; j-- {
+		if c := nodes[j]; c.Kind == ast.ElementNode && !c.Pending && contains(p.tags[c.Name].Parents, n.Name) {
+			p.pend(body, tagRe, parent, i+j)
+		}
+	}
+}
+
+// inLink returns whether one of the elements in stack is a link.
+func (p *Parser) inLink(stack []*ast.Node) bool {
+	for _, n := range stack[1:] {
+		if contains(p.tags[n.Name].Tags, "a") {
+			return true
+		}
+	}
+	return false
+}
+
+// findTag is like find, but skips the tags in the body of a tag with htmlTags that are escaped,
+// unless the body isn't parsed.
+func (p *Parser) findTag(htmlTags HtmlTags, re *regexp.Regexp, body string, start int) []int {
+	for from := start; ; {
+		loc := find(re, body, from)
+		if loc == nil || htmlTags.Options&token.NoParseInner != 0 || p.escapes(body[start:loc[0]])%2 == 0 {
+			return loc
+		}
+		from = loc[0] + 1
+	}
+}
+
+// allows returns whether perms allows the tag named name, or the tag it is an alias of.
+func (p *Parser) allows(perms *permission.Set, name string) bool {
+	return perms.AllowsAlias(name, p.tags[name].Alias)
+}
+
+// closingDelim returns the offset from start of the first delim in body that closes a Symmetric
+// tag whose body starts at start, or -1 if there is none or the tag's BodyValidFunc rejects the
+// body before it. Escaped delimiters can't close it, unless its body isn't parsed.
+func (p *Parser) closingDelim(htmlTags HtmlTags, delim, body string, start int) int {
+	for from := start; ; {
+		i := strings.Index(body[from:], delim)
+		if i < 0 {
+			return -1
+		}
+		end := from + i
+		if htmlTags.Options&token.NoParseInner != 0 || p.escapes(body[start:end])%2 == 0 {
+			if htmlTags.BodyValidFunc != nil && !htmlTags.BodyValidFunc(body[start:end], body[end+len(delim):]) {
+				return -1
 			}
+			return end - start
+		}
+		from = end + 1
+	}
+}
 
-			tagStack.push(&bbTagPair{htmlTags, tagData[0]})
+// escapes returns the number of escape characters at the end of s.
+func (p *Parser) escapes(s string) int {
+	if p.EscapeChar == 0 {
+		return 0
+	}
+	n := 0
+	for r, size := utf8.DecodeLastRuneInString(s); size > 0 && r == p.EscapeChar; r, size = utf8.DecodeLastRuneInString(s) {
+		s = s[:len(s)-size]
+		n++
+	}
+	return n
+}
 
-			if htmlTags.Options&token.NoParseInner != 0 {
-				closeTagRe, err := bbCloseTag(tagData[0])
-				if err != nil {
-					return "", err
+// Escape returns markup that p parses into text, by escaping the tags and delimiters in it.
+// Escape characters are doubled, so the result can be put next to other markup.
+func (p *Parser) Escape(text string) string {
+	if p.EscapeChar == 0 {
+		return text
+	}
+	esc := string(p.EscapeChar)
+	tagRe := p.tagRe
+	if tagRe == nil {
+		tagRe = bbCodeRe
+	}
+
+	buf := &bytes.Buffer{}
+	for pos := 0; pos < len(text); {
+		end, tagEnd := len(text), len(text)
+		if loc := find(tagRe, text, pos); loc != nil {
+			end, tagEnd = loc[0], loc[1]
+		}
+		buf.WriteString(strings.Replace(text[pos:end], esc, esc+esc, -1))
+		if end < tagEnd {
+			buf.WriteString(esc + text[end:tagEnd])
+		}
+		pos = tagEnd
+	}
+	return buf.String()
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
+
+// innermost returns the index of the last node in stack named one of names, or 0 if there is none.
+func innermost(stack []*ast.Node, names []string) int {
+	for i := len(stack) - 1; i > 0; i-- {
+		if contains(names, stack[i].Name) {
+			return i
+		}
+	}
+	return 0
+}
+
+// fixChildren makes sure that the children of n and its descendants are allowed by
+// their HtmlTags.Children, that there are no more of them than MaxChildren, and that
+// they aren't nested more than MaxDepth deep. depths holds the depth of each tag name above n.
+func (p *Parser) fixChildren(doc *ast.Document, n *ast.Node, depths map[string]int) {
+	if n.Pending {
+		return
+	}
+	htmlTags := p.tags[n.Name]
+	if n.Kind == ast.ElementNode {
+		depths[n.Name]++
+		defer func() { depths[n.Name]-- }()
+
+		if max := htmlTags.MaxDepth; max > 0 && depths[n.Name] > max && len(n.Children) != 0 {
+			doc.Diagnose(n.Span, "[%s] is nested more than %d deep, so its contents were hidden", n.Name, max)
+			hidden := token.Span{Start: n.Children[0].Span.Start, End: n.LastChild().Span.End}
+			n.Children = []*ast.Node{ast.NewText("…", hidden)}
+		}
+	}
+
+	if allowed := htmlTags.Children; n.Kind == ast.ElementNode && allowed != nil {
+		children := make([]*ast.Node, 0, len(n.Children))
+		var wrapper *ast.Node
+		for _, c := range n.Children {
+			switch {
+			case c.Kind == ast.ElementNode && contains(allowed, c.Name):
+				children = append(children, c)
+				wrapper = nil
+				continue
+			case wrapper == nil && c.Kind == ast.TextNode && strings.TrimSpace(c.Text) == "":
+				continue
+			case wrapper == nil:
+				doc.Diagnose(c.Span, "[%s] can only contain %s", n.Name, "["+strings.Join(allowed, "], [")+"]")
+				wrapper = ast.NewElement(allowed[0], make([]string, 2), c.Span)
+				children = append(children, wrapper)
+			}
+			wrapper.Children = append(wrapper.Children, c)
+			wrapper.Span.End = c.Span.End
+		}
+		n.Children = children
+	}
+
+	if max := htmlTags.MaxChildren; n.Kind == ast.ElementNode && max > 0 && len(n.Children) > max {
+		dropped := token.Span{Start: n.Children[max].Span.Start, End: n.LastChild().Span.End}
+		doc.Diagnose(dropped, "[%s] can't have more than %d children, so the rest were dropped", n.Name, max)
+		n.Children = n.Children[:max]
+	}
+
+	for _, c := range n.Children {
+		p.fixChildren(doc, c, depths)
+	}
+}
+
+// hoistBlocks makes sure that no Block element is inside an inline or PhrasingOnly one, and returns
+// the nodes that replace n. An inline element containing blocks is split around them, and copies of
+// it are pushed into the blocks, i.e. [b]x[h1]y[/h1][/b] becomes [b]x[/b][h1][b]y[/b][/h1].
+func (p *Parser) hoistBlocks(doc *ast.Document, n *ast.Node) []*ast.Node {
+	children := make([]*ast.Node, 0, len(n.Children))
+	hasBlock := false
+	for _, c := range n.Children {
+		for _, hoisted := range p.hoistBlocks(doc, c) {
+			children = append(children, hoisted)
+			hasBlock = hasBlock || p.isBlock(hoisted)
+		}
+	}
+	n.Children = children
+	if n.Kind != ast.ElementNode || !hasBlock || p.isBlock(n) && !p.tags[n.Name].PhrasingOnly {
+		return []*ast.Node{n}
+	}
+
+	for _, c := range children {
+		if p.isBlock(c) {
+			doc.Diagnose(c.Span, "[%s] can't be inside [%s], so [%s] was split around it", c.Name, n.Name, n.Name)
+		}
+	}
+	return p.wrapInline(n, children)
+}
+
+// wrapInline returns nodes with every run of inline nodes wrapped in a copy of the inline or
+// PhrasingOnly element n. Copies of n are also pushed into the blocks in nodes, unless their bodies
+// aren't parsed or both are PhrasingOnly, so [h1][h2]x[/h2][/h1] becomes [h2]x[/h2].
+func (p *Parser) wrapInline(n *ast.Node, nodes []*ast.Node) []*ast.Node {
+	ret := make([]*ast.Node, 0, len(nodes))
+	var part *ast.Node // The copy of n holding the inline nodes since the last block
+	for _, c := range nodes {
+		if !p.isBlock(c) {
+			if part == nil {
+				part = ast.NewElement(n.Name, n.Args, c.Span)
+				ret = append(ret, part)
+			}
+			part.Children = append(part.Children, c)
+			part.Span.End = c.Span.End
+			continue
+		}
+
+		if p.tags[c.Name].Options&token.NoParseInner == 0 && !(p.tags[n.Name].PhrasingOnly && p.tags[c.Name].PhrasingOnly) {
+			c.Children = p.wrapInline(n, c.Children)
+		}
+		ret = append(ret, c)
+		part = nil
+	}
+	return ret
+}
+
+// channelRe matches a #channel reference. Names start with a letter, so "#1" isn't a channel.
+var channelRe = regexp.MustCompile(`#(\pL(?:[\pL\pN_-]*[\pL\pN_])?)`)
+
+// linkChannels turns the #channel references in the text under n into "#" elements with the
+// channel's name, ID and URL as args. Text that isn't parsed, or is already in a link, is skipped.
+func (p *Parser) linkChannels(ctx context.Context, doc *ast.Document, n *ast.Node) {
+	if htmlTags := p.tags[n.Name]; n.Kind == ast.ElementNode &&
+		(n.Pending || htmlTags.Options&token.NoParseInner != 0 || contains(htmlTags.Tags, "a")) {
+		return
+	}
+
+	children := make([]*ast.Node, 0, len(n.Children))
+	for _, c := range n.Children {
+		if c.Kind != ast.TextNode {
+			p.linkChannels(ctx, doc, c)
+			children = append(children, c)
+			continue
+		}
+
+		last := 0 // The end of the last reference in c
+		for _, loc := range channelRe.FindAllStringSubmatchIndex(c.Text, -1) {
+			// References must start at a word boundary, so "C#" isn't one
+			if prev, _ := utf8.DecodeLastRuneInString(c.Text[:loc[0]]); loc[0] != 0 &&
+				(unicode.IsLetter(prev) || unicode.IsDigit(prev) || strings.ContainsRune("_#&", prev)) {
+				continue
+			}
+			name := c.Text[loc[2]:loc[3]]
+			id, url, ok := p.ResolveChannel(ctx, name)
+			if !ok {
+				continue
+			}
+
+			if last < loc[0] {
+				children = append(children, ast.NewText(c.Text[last:loc[0]], token.Span{Start: c.Span.Start + last, End: c.Span.Start + loc[0]}))
+			}
+			span := token.Span{Start: c.Span.Start + loc[0], End: c.Span.Start + loc[1]}
+			link := ast.NewElement("#", []string{name, id, url}, span)
+			link.AppendText(c.Text[loc[0]:loc[1]], span)
+			children = append(children, link)
+			doc.AddChannel(id)
+			last = loc[1]
+		}
+
+		switch {
+		case last == 0:
+			children = append(children, c)
+		case last < len(c.Text):
+			children = append(children, ast.NewText(c.Text[last:], token.Span{Start: c.Span.Start + last, End: c.Span.End}))
+		}
+	}
+	n.Children = children
+}
+
+// addLinks adds the URLs that n and the nodes under it render to doc.Links.
+func (p *Parser) addLinks(doc *ast.Document, n *ast.Node) {
+	n.Walk(func(n *ast.Node) bool {
+		if n.Kind == ast.ElementNode && !n.Pending {
+			for _, link := range tagLinks(p.tags[n.Name], n.Args) {
+				link.Span = n.Span
+				doc.Links = append(doc.Links, link)
+			}
+		}
+		return true
+	})
+}
+
+// tagLinks returns the URLs an element of htmlTags with the given args renders. URLs with a scheme
+// other than http, https or mailto are left out, since html/template replaces them in Attributes,
+// and those from a LinkFunc may come from resolvers.
+func tagLinks(htmlTags HtmlTags, args []string) []ast.Link {
+	if htmlTags.LinkFunc != nil {
+		var links []ast.Link
+		for _, link := range htmlTags.LinkFunc(args) {
+			if safeScheme(link.URL) {
+				links = append(links, link)
+			}
+		}
+		return links
+	}
+	if htmlTags.OutputFunc != nil {
+		return nil
+	}
+
+	var links []ast.Link
+	for i, attrs := range htmlTags.Attributes {
+		for _, arg := range sortedArgs(attrs) {
+			kind := ast.Hyperlink
+			switch attrs[arg] {
+			case "href":
+			case "src":
+				kind = ast.Media
+				if i < len(htmlTags.Tags) && htmlTags.Tags[i] == "img" {
+					kind = ast.Image
 				}
-				closeTagLoc := closeTagRe.FindIndex([]byte(body))
+			default:
+				continue
+			}
+			if url := argAt(args, int(arg)); url != "" && safeScheme(url) {
+				links = append(links, ast.Link{URL: url, Kind: kind})
+			}
+		}
+	}
+	return links
+}
 
-				if closeTagLoc == nil {
-					output += body
-					body = ""
-				} else {
-					output += body[:closeTagLoc[0]]
-					output += closeTags(tagStack.pop())
-					body = body[closeTagLoc[1]:]
+// safeScheme returns whether html/template leaves url in an attribute alone, which it does if url is
+// relative or its scheme is http, https or mailto.
+func safeScheme(url string) bool {
+	i := strings.IndexByte(url, ':')
+	if i < 0 || strings.Contains(url[:i], "/") {
+		return true
+	}
+	switch strings.ToLower(url[:i]) {
+	case "http", "https", "mailto":
+		return true
+	}
+	return false
+}
+
+// RenderHTML converts n to HTML using p's tags.
+func (p *Parser) RenderHTML(n *ast.Node) (string, error) {
+	buf := &bytes.Buffer{}
+	err := p.renderHTML(buf, n, false)
+	return buf.String(), err
+}
+
+// renderHTML writes n to buf. keepNewlines is set inside tags with KeepNewlines.
+func (p *Parser) renderHTML(buf *bytes.Buffer, n *ast.Node, keepNewlines bool) error {
+	switch n.Kind {
+	case ast.DocumentNode:
+		if p.Newlines == Paragraphs {
+			return p.renderParagraphs(buf, n)
+		}
+	case ast.TextNode:
+		p.writeText(buf, n.Text, keepNewlines)
+		return nil
+	case ast.ElementNode:
+		if n.Pending {
+			buf.WriteString(`<span class="pending">`)
+			defer buf.WriteString("</span>")
+			break
+		}
+		htmlTags := p.tags[n.Name]
+		keepNewlines = keepNewlines || htmlTags.KeepNewlines
+		openHtml, err := openTags(htmlTags, n.Args)
+		if err != nil {
+			return err
+		}
+		buf.WriteString(openHtml)
+		defer func() { buf.WriteString(closeTags(htmlTags, n.Args)) }()
+
+		if htmlTags.Code && p.Highlight != nil {
+			if out, ok := p.Highlight(n.Arg(0), p.RenderText(n)); ok {
+				buf.WriteString(out)
+				return nil
+			}
+		}
+	}
+
+	for _, c := range n.Children {
+		if err := p.renderHTML(buf, c, keepNewlines); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// paragraphBreakRe matches the blank lines between paragraphs.
+var paragraphBreakRe = regexp.MustCompile(`\n[ \t]*\n(?:[ \t]*\n)*`)
+
+// writeText writes escaped text to buf, handling its newlines as set by p.Newlines and p.MaxBlankLines
+// unless keepNewlines is set.
+func (p *Parser) writeText(buf *bytes.Buffer, text string, keepNewlines bool) {
+	if keepNewlines || p.Newlines == PreserveNewlines && p.MaxBlankLines <= 0 {
+		buf.WriteString(html.EscapeString(text))
+		return
+	}
+
+	text = strings.Replace(text, "\r\n", "\n", -1)
+	if p.MaxBlankLines > 0 {
+		max := strings.Repeat("\n", p.MaxBlankLines+1)
+		text = paragraphBreakRe.ReplaceAllStringFunc(text, func(blank string) string {
+			if strings.Count(blank, "\n") > p.MaxBlankLines+1 {
+				return max
+			}
+			return blank
+		})
+	}
+
+	text = html.EscapeString(text)
+	if p.Newlines != PreserveNewlines {
+		text = strings.Replace(text, "\n", "<br>", -1)
+	}
+	buf.WriteString(text)
+}
+
+// isBlock returns whether n is an element of a Block tag.
+func (p *Parser) isBlock(n *ast.Node) bool {
+	return n.Kind == ast.ElementNode && !n.Pending && p.tags[n.Name].Block
+}
+
+// renderParagraphs writes the children of n to buf as paragraphs separated by blank lines.
+// Block tags are written between the paragraphs.
+func (p *Parser) renderParagraphs(buf *bytes.Buffer, n *ast.Node) error {
+	open := false
+	openP := func() {
+		if !open {
+			buf.WriteString("<p>")
+			open = true
+		}
+	}
+	closeP := func() {
+		if open {
+			buf.WriteString("</p>")
+			open = false
+		}
+	}
+
+	for i, c := range n.Children {
+		switch {
+		case p.isBlock(c):
+			closeP()
+			if err := p.renderHTML(buf, c, false); err != nil {
+				return err
+			}
+		case c.Kind != ast.TextNode:
+			openP()
+			if err := p.renderHTML(buf, c, false); err != nil {
+				return err
+			}
+		default:
+			// Newlines next to paragraph breaks and blocks are dropped instead of becoming <br>s
+			beforeBlock := i+1 == len(n.Children) || p.isBlock(n.Children[i+1])
+			paragraphs := paragraphBreakRe.Split(strings.Replace(c.Text, "\r\n", "\n", -1), -1)
+			for j, text := range paragraphs {
+				if j > 0 {
+					closeP()
 				}
-			} else if htmlTags.Options&token.PossibleSingle != 0 {
-				closeTagRe, err := bbCloseTag(tagData[0])
-				if err != nil {
-					return "", err
+				if !open {
+					text = strings.TrimLeft(text, "\n")
 				}
-				closeTagLoc := closeTagRe.FindIndex([]byte(body))
-				if closeTagLoc != nil {
-					tagRe, err := bbTag(tagData[0])
-					if err != nil {
-						return "", err
-					}
-					openTagLoc := tagRe.FindIndex([]byte(body))
-					if openTagLoc != nil && openTagLoc[0] < closeTagLoc[0] {
-						if htmlTags.Options&token.HtmlSingle == 0 {
-							output += closeTags(tagStack.pop())
-						}
-					}
-				} else {
-					if htmlTags.Options&token.HtmlSingle == 0 {
-						output += closeTags(tagStack.pop())
-					}
+				if j < len(paragraphs)-1 || beforeBlock {
+					text = strings.TrimRight(text, "\n")
 				}
+				if !open && strings.TrimSpace(text) == "" {
+					continue
+				}
+				openP()
+				p.writeText(buf, text, false)
 			}
-		} else if cok {
-			tagStackCopy := &stack{nodes: tagStack.nodes, count: tagStack.count}
-			foundMatch := false
-			for tagPair := tagStackCopy.pop(); tagPair != nil; tagPair = tagStackCopy.pop() {
-				if tagPair.bbName == tagData[0][1:] {
-					output += body[:tagLoc[0]]
-					output += closeNTags(tagStack, tagStack.count-tagStackCopy.count)
-					body = body[tagLoc[1]:]
-					foundMatch = true
-					break
+		}
+	}
+	closeP()
+	return nil
+}
+
+// RenderText converts n to plain text, dropping all markup.
+// The contents of tags with a TextMask are replaced with the mask.
+func (p *Parser) RenderText(n *ast.Node) string {
+	if n.Kind == ast.TextNode {
+		return n.Text
+	}
+	if mask := p.tags[n.Name].TextMask; n.Kind == ast.ElementNode && !n.Pending && mask != "" {
+		return mask
+	}
+	text := ""
+	for _, c := range n.Children {
+		text += p.RenderText(c)
+	}
+	return text
+}
+
+// RenderNotification converts n to a single line of plain text for use in notifications.
+// It is like RenderText, but runs of whitespace are collapsed into single spaces, and if max
+// is positive, the text is cut to at most max grapheme clusters ending in "…".
+func (p *Parser) RenderNotification(n *ast.Node, max int) string {
+	text := strings.Join(strings.Fields(p.RenderText(n)), " ")
+	if max > 0 && grapheme.Count(text) > max {
+		text = strings.TrimRight(text[:grapheme.Index(text, max-1)], " ") + "…"
+	}
+	return text
+}
+
+// Length returns the visible length of n: the number of grapheme clusters in its text, so an
+// emoji or an accented letter counts as one, plus one for each element of a Unit tag.
+func (p *Parser) Length(n *ast.Node) int {
+	if n.Kind == ast.TextNode {
+		return grapheme.Count(n.Text)
+	}
+	if p.isUnit(n) {
+		return 1
+	}
+	length := 0
+	for _, c := range n.Children {
+		length += p.Length(c)
+	}
+	return length
+}
+
+// isUnit returns whether n is an element of a Unit tag.
+func (p *Parser) isUnit(n *ast.Node) bool {
+	return n.Kind == ast.ElementNode && !n.Pending && p.tags[n.Name].Unit
+}
+
+// Truncate returns n if its Length is at most max. Otherwise it returns a copy of n cut to
+// max visible units, the last of which is "…", with the rest of the message dropped and the
+// elements the cut falls in closed after the "…". Text is only cut between grapheme clusters
+// and Unit elements are kept whole, so characters and emoji are never split, and as text is
+// escaped when it is rendered, HTML entities aren't either. If max <= 0, not even the "…" fits,
+// so an empty copy of n is returned.
+func (p *Parser) Truncate(n *ast.Node, max int) *ast.Node {
+	if p.Length(n) <= max {
+		return n
+	}
+	if max <= 0 {
+		t := *n
+		t.Text, t.Children = "", nil
+		return &t
+	}
+	left := max - 1
+	t, _ := p.truncate(n, &left)
+	return t
+}
+
+// truncate returns n with left visible units taken from it, and whether it had to be cut to
+// fit. A cut copy ends in "…", except for a Unit element, which is dropped instead (nil).
+func (p *Parser) truncate(n *ast.Node, left *int) (*ast.Node, bool) {
+	length := p.Length(n)
+	if length <= *left {
+		*left -= length
+		return n, false
+	}
+	if n.Kind == ast.TextNode {
+		text := n.Text[:grapheme.Index(n.Text, *left)] + "…"
+		*left = 0
+		return ast.NewText(text, n.Span), true
+	}
+	if p.isUnit(n) {
+		return nil, true
+	}
+
+	t := *n
+	t.Children = nil
+	for _, c := range n.Children {
+		tc, cut := p.truncate(c, left)
+		if tc == nil {
+			tc = ast.NewText("…", token.Span{Start: c.Span.Start, End: c.Span.Start})
+		}
+		t.Children = append(t.Children, tc)
+		if cut {
+			break
+		}
+	}
+	return &t, true
+}
+
+// RenderTokens converts tokens to HTML. Text is escaped, and TagTokens are rendered
+// using the tag in p with the same name; TagTokens with no such tag are dropped.
+// This is used to render the output of a lexer built from the same tags as p.
+func (p *Parser) RenderTokens(tokens []token.Token) (string, error) {
+	buf := &bytes.Buffer{}
+	openArgs := make(map[string][][]string) // The args of the open tokens for each name, for CloseFunc
+	keepNewlines := 0                       // The number of open tokens with KeepNewlines
+	for _, t := range tokens {
+		switch t := t.(type) {
+		case *token.TextToken:
+			text, err := t.Output()
+			if err != nil {
+				return "", err
+			}
+			p.writeText(buf, text, keepNewlines > 0)
+		case *token.TagToken:
+			htmlTags, ok := p.tags[t.Name]
+			if !ok {
+				continue
+			}
+			if t.Kind != token.CloseToken {
+				openHtml, err := openTags(htmlTags, t.Args)
+				if err != nil {
+					return "", err
 				}
+				buf.WriteString(openHtml)
 			}
 
-			if !foundMatch {
-				output += body[tagLoc[0]:tagLoc[1]]
-				body = body[tagLoc[1]:]
+			args := t.Args
+			switch t.Kind {
+			case token.OpenToken:
+				openArgs[t.Name] = append(openArgs[t.Name], t.Args)
+				if htmlTags.KeepNewlines {
+					keepNewlines++
+				}
+			case token.CloseToken:
+				if open := openArgs[t.Name]; len(open) != 0 {
+					args = open[len(open)-1]
+					openArgs[t.Name] = open[:len(open)-1]
+					if htmlTags.KeepNewlines {
+						keepNewlines--
+					}
+				}
+			}
+			if t.Kind != token.OpenToken {
+				buf.WriteString(closeTags(htmlTags, args))
 			}
-		} else {
-			output += body[:tagLoc[1]]
-			body = body[tagLoc[1]:]
 		}
 	}
-
-	output += closeNTags(tagStack, tagStack.count)
-	return output, nil
+	return buf.String(), nil
 }
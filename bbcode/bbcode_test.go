@@ -2,8 +2,18 @@ package bbcode_test
 
 import (
 	"."
+	"context"
 	"fmt"
+	"github.com/moechat/parser/htmlcheck"
+	"github.com/moechat/parser/imageproxy"
+	"github.com/moechat/parser/media"
+	"github.com/moechat/parser/parsectx"
+	"github.com/moechat/parser/permission"
+	"github.com/moechat/parser/token"
+	"math/rand"
+	"strings"
 	"testing"
+	"time"
 )
 
 func TestBbCodeParse(t *testing.T) {
@@ -13,7 +23,7 @@ This seems to work very well :D [url][/url] [size=12px]something
 
 	out, err := bbcode.Parse(testString)
 	if err != nil {
-		fmt.Printf("Parsing failed! Error:", err)
+		fmt.Println("Parsing failed! Error:", err)
 	}
 	fmt.Println("Parse succeeeded. Output is:")
 	fmt.Println(out)
@@ -21,8 +31,765 @@ This seems to work very well :D [url][/url] [size=12px]something
 	testString1 := "[url=http://google.com/][img]http://www.google.com/intl/en_ALL/images/logo.gif[/img][/url]"
 	out1, err := bbcode.Parse(testString1)
 	if err != nil {
-		fmt.Printf("Parsing failed! Error:", err)
+		fmt.Println("Parsing failed! Error:", err)
 	}
 	fmt.Println("Parse succeeeded. Output is:")
 	fmt.Println(out1)
 }
+
+func TestParseDocument(t *testing.T) {
+	doc, err := bbcode.ParseDocument("[b]a<[i]b[/b] [/i][noparse][b][/noparse][q]")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	var tokens []string
+	for _, tok := range doc.Root.Tokens() {
+		switch tok := tok.(type) {
+		case *token.TextToken:
+			text, _ := tok.Output()
+			tokens = append(tokens, text)
+		case *token.TagToken:
+			tokens = append(tokens, fmt.Sprint(tok.Kind, tok.Name))
+		}
+	}
+	expected := []string{"1b", "a<", "1i", "b", "2i", "2b", " [/i]", "1noparse", "[b]", "2noparse", "0q"}
+	if fmt.Sprint(tokens) != fmt.Sprint(expected) {
+		t.Errorf("Expected tokens %q, got %q", expected, tokens)
+	}
+
+	diagnostics := []string{
+		"9-13: [/b] closes [i], which was opened inside it",
+		"14-18: [/i] doesn't close any tag",
+		"40-43: [q] is never closed",
+	}
+	if len(doc.Diagnostics) != len(diagnostics) {
+		t.Fatalf("Expected diagnostics %q, got %q", diagnostics, doc.Diagnostics)
+	}
+	for i, d := range doc.Diagnostics {
+		if d.String() != diagnostics[i] {
+			t.Errorf("Expected diagnostic %q, got %q", diagnostics[i], d)
+		}
+	}
+
+	out, err := bbcode.Parse("[b]a<[i]b[/b]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "<b>a&lt;<i>b</i></b>" {
+		t.Errorf("Parse output is %q", out)
+	}
+}
+
+func TestLists(t *testing.T) {
+	tests := map[string]string{
+		"[list]\n[*]a\n[*]b [b]c\n[/list]":               "<ul><li>a\n</li><li>b <b>c\n</b></li></ul>",
+		"[list=1][*]a[list=i][*]b[*]c[/list][*]d[/list]": `<ol type="1"><li>a<ol type="i"><li>b</li><li>c</li></ol></li><li>d</li></ol>`,
+		"[list=x]stray[*]a[/list]":                       "<ul><li>stray</li><li>a</li></ul>",
+		"[*]not an item [list][*]item":                   "[*]not an item <ul><li>item</li></ul>",
+		"[list][*]a[/list][*]b":                          "<ul><li>a</li></ul>[*]b",
+		"[list][*][i]x[*]y[/list]":                       "<ul><li><i>x</i></li><li>y</li></ul>",
+	}
+
+	for input, expected := range tests {
+		out, err := bbcode.Parse(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != expected {
+			t.Errorf("%q parsed as %q, expected %q", input, out, expected)
+		}
+	}
+}
+
+func TestTables(t *testing.T) {
+	tests := map[string]string{
+		"[table]\n[tr][th]a[/th][th]b[/th][/tr]\n[tr][td]1[td]2\n[/table]": "<table><tr><th>a</th><th>b</th></tr><tr><td>1</td><td>2\n</td></tr></table>",
+		"[table]stray[tr][td]x[/td][/tr][/table]":                          "<table><tr><td>stray</td></tr><tr><td>x</td></tr></table>",
+		"[td]x[/td] [tr]y[/tr]":                                            "[td]x[/td] [tr]y[/tr]",
+		"[table][tr][td][b]x[/table]":                                      "<table><tr><td><b>x</b></td></tr></table>",
+		"[table][tr][td]a[tr][td]b":                                        "<table><tr><td>a</td></tr><tr><td>b</td></tr></table>",
+	}
+
+	for input, expected := range tests {
+		out, err := bbcode.Parse(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != expected {
+			t.Errorf("%q parsed as %q, expected %q", input, out, expected)
+		}
+	}
+
+	tags := bbcode.DefaultTags()
+	table, row := tags["table"], tags["tr"]
+	table.MaxChildren, row.MaxChildren = 2, 1
+	tags["table"], tags["tr"] = table, row
+
+	doc, err := bbcode.NewParser(tags).ParseDocument("[table][tr][td]a[td]b[tr][tr][/table]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	out, err := bbcode.NewParser(tags).RenderHTML(doc.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != "<table><tr><td>a</td></tr><tr></tr></table>" {
+		t.Errorf("Limited table parsed as %q", out)
+	}
+	if len(doc.Diagnostics) != 2 {
+		t.Errorf("Expected 2 diagnostics for the limited table, got %q", doc.Diagnostics)
+	}
+}
+
+func TestQuotes(t *testing.T) {
+	p := bbcode.NewParser(bbcode.DefaultTags())
+	p.MessageURL = func(ctx context.Context, id string) string {
+		if id == "123" {
+			return "/m/123"
+		}
+		return ""
+	}
+
+	tests := map[string]string{
+		"[quote]hi[/quote]":                                                  `<blockquote class="quote">hi</blockquote>`,
+		"[quote=a<b]hi[/quote]":                                              `<blockquote class="quote"><cite>a&lt;b</cite>hi</blockquote>`,
+		`[quote name="Moe Chan" msg=123]hi[/quote]`:                          `<blockquote class="quote"><cite><a href="/m/123">Moe Chan</a></cite>hi</blockquote>`,
+		"[quote msg=123]hi[/quote]":                                          `<blockquote class="quote"><cite><a href="/m/123">Quoted message</a></cite>hi</blockquote>`,
+		"[quote name=x msg=404]hi[/quote]":                                   `<blockquote class="quote"><cite>x</cite>hi</blockquote>`,
+		"[quote bogus=1]hi[/quote]":                                          "[quote bogus=1]hi[/quote]",
+		"[quote][quote][quote][quote]deep[/quote][/quote]a[/quote]b[/quote]": `<blockquote class="quote"><blockquote class="quote"><blockquote class="quote"><blockquote class="quote">…</blockquote></blockquote>a</blockquote>b</blockquote>`,
+	}
+
+	for input, expected := range tests {
+		out, err := p.Parse(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != expected {
+			t.Errorf("%q parsed as %q, expected %q", input, out, expected)
+		}
+	}
+}
+
+func TestSpoilers(t *testing.T) {
+	tests := map[string]string{
+		"[spoiler]Moe dies[/spoiler]":          `<details class="spoiler"><summary>Spoiler</summary>Moe dies</details>`,
+		"[spoiler=Ep <12>]x[/spoiler]":         `<details class="spoiler"><summary>Ep &lt;12&gt;</summary>x</details>`,
+		"a ||secret [b]bold[/b]|| b":           `a <span class="spoiler" role="button" tabindex="0" aria-expanded="false">secret <b>bold</b></span> b`,
+		"a || b":                               "a || b",
+		"||x [i]y|| z":                         `<span class="spoiler" role="button" tabindex="0" aria-expanded="false">x <i>y</i></span> z`,
+		"[code]||not a spoiler||[/code] ||x||": `<pre><code>||not a spoiler||</code></pre> <span class="spoiler" role="button" tabindex="0" aria-expanded="false">x</span>`,
+	}
+
+	for input, expected := range tests {
+		out, err := bbcode.Parse(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != expected {
+			t.Errorf("%q parsed as %q, expected %q", input, out, expected)
+		}
+	}
+
+	p := bbcode.NewParser(bbcode.DefaultTags())
+	doc, err := p.ParseDocument("Did you see ||Moe   dies||?\n[spoiler=Ep 12]She lives[/spoiler]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := p.RenderText(doc.Root); text != "Did you see (spoiler)?\n(spoiler)" {
+		t.Errorf("Spoilers rendered as text %q", text)
+	}
+	if text := p.RenderNotification(doc.Root, 20); text != "Did you see (spoile…" {
+		t.Errorf("Spoilers rendered as notification %q", text)
+	}
+}
+
+func TestCode(t *testing.T) {
+	p := bbcode.NewParser(bbcode.DefaultTags())
+	tests := map[string]string{
+		"[code]x[/code]":                  "<pre><code>x</code></pre>",
+		"[code=Go]if x[/code]":            `<pre><code class="language-go">if x</code></pre>`,
+		`[code="><script>]x[/code]`:       "<pre><code>x</code></pre>",
+		"```go\nif [b]x[/b]\n``` after":   "<pre><code class=\"language-go\">if [b]x[/b]</code></pre> after",
+		"```\nplain\n```":                 "<pre><code>plain</code></pre>",
+		"inline ```x``` and ``` unclosed": "inline <pre><code>x</code></pre> and ``` unclosed",
+	}
+	for input, expected := range tests {
+		out, err := p.Parse(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != expected {
+			t.Errorf("%q parsed as %q, expected %q", input, out, expected)
+		}
+	}
+
+	p.Highlight = func(lang, code string) (string, bool) {
+		if lang != "go" {
+			return "", false
+		}
+		return "<span>" + code + "</span>", true
+	}
+	for input, expected := range map[string]string{
+		"```go\nx\n```":         `<pre><code class="language-go"><span>x</span></code></pre>`,
+		"[code=lisp]<x>[/code]": `<pre><code class="language-lisp">&lt;x&gt;</code></pre>`,
+	} {
+		if out, _ := p.Parse(input); out != expected {
+			t.Errorf("%q highlighted as %q, expected %q", input, out, expected)
+		}
+	}
+}
+
+func TestNewlines(t *testing.T) {
+	input := "a\nb\n\n\n\n[b]c\nd[/b]\n[code]x\n\ny[/code]\ne"
+	tests := []struct {
+		mode     bbcode.NewlineMode
+		max      int
+		expected string
+	}{
+		{bbcode.PreserveNewlines, 0, "a\nb\n\n\n\n<b>c\nd</b>\n<pre><code>x\n\ny</code></pre>\ne"},
+		{bbcode.PreserveNewlines, 1, "a\nb\n\n<b>c\nd</b>\n<pre><code>x\n\ny</code></pre>\ne"},
+		{bbcode.BreakNewlines, 0, "a<br>b<br><br><br><br><b>c<br>d</b><br><pre><code>x\n\ny</code></pre><br>e"},
+		{bbcode.BreakNewlines, 2, "a<br>b<br><br><br><b>c<br>d</b><br><pre><code>x\n\ny</code></pre><br>e"},
+		{bbcode.Paragraphs, 0, "<p>a<br>b</p><p><b>c<br>d</b></p><pre><code>x\n\ny</code></pre><p>e</p>"},
+	}
+
+	for _, test := range tests {
+		p := bbcode.NewParser(bbcode.DefaultTags())
+		p.Newlines, p.MaxBlankLines = test.mode, test.max
+		out, err := p.Parse(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != test.expected {
+			t.Errorf("Mode %d with at most %d blank lines output %q, expected %q", test.mode, test.max, out, test.expected)
+		}
+	}
+}
+
+func TestBlocks(t *testing.T) {
+	tests := map[string]string{
+		"[h1]Rules[/h1][hr][center]Be nice[/center]": `<h1>Rules</h1><hr><div class=" align-center">Be nice</div>`,
+		"[h1][h2]x[/h2][/h1]":                        "<h2>x</h2>",
+		"[h1]a[center]x[/center]b[/h1]":              `<h1>a</h1><div class=" align-center"><h1>x</h1></div><h1>b</h1>`,
+		"[h1][center][h2]x[/h2] y[/center][/h1]":     `<div class=" align-center"><h2>x</h2><h1> y</h1></div>`,
+		"[b]x[h2]y[/h2]z[/b]":                        "<b>x</b><h2><b>y</b></h2><b>z</b>",
+		"[i][right]a[list][*]b[/list][/right][/i]":   `<div class=" align-right"><i>a</i><ul><li><i>b</i></li></ul></div>`,
+		"[url=http://a][code]x[/code][/url]":         `<pre><code>x</code></pre>`,
+	}
+	for input, expected := range tests {
+		out, err := bbcode.Parse(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != expected {
+			t.Errorf("%q parsed as %q, expected %q", input, out, expected)
+		}
+	}
+
+	doc, err := bbcode.ParseDocument("[b]x[h2]y[/h2][/b]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(doc.Diagnostics) != 1 || doc.Diagnostics[0].Msg != "[h2] can't be inside [b], so [b] was split around it" {
+		t.Errorf("Unexpected diagnostics %q", doc.Diagnostics)
+	}
+}
+
+func TestMath(t *testing.T) {
+	tests := map[string]string{
+		"$x^2 < [b]y[/b]$":                      `<span class="math inline">x^2 &lt; [b]y[/b]</span>`,
+		"$$\\sum_i x_i$$":                       `<span class="math display">\sum_i x_i</span>`,
+		"[math]a_b[/math] [tex=display]c[/tex]": `<span class="math inline">a_b</span> <span class="math display">c</span>`,
+		"$5 and $10":                            "$5 and $10",
+		"costs $5, or $x$ each":                 `costs $5, or <span class="math inline">x</span> each`,
+		"$ x$ and $y $ and $z$1":                "$ x$ and $y $ and $z$1",
+	}
+	for input, expected := range tests {
+		out, err := bbcode.Parse(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != expected {
+			t.Errorf("%q parsed as %q, expected %q", input, out, expected)
+		}
+	}
+
+	p := bbcode.NewParser(bbcode.DefaultTags())
+	doc, err := p.ParseDocument("so $e^{i\\pi}$ [b]is[/b] $$-1$$")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := p.RenderText(doc.Root); text != "so e^{i\\pi} is -1" {
+		t.Errorf("Math rendered as text %q", text)
+	}
+
+	// Each $ only looks as far as the next one, so this takes linear time
+	input := strings.Repeat("$5 ", 20000)
+	start := time.Now()
+	if out, err := bbcode.Parse(input); err != nil || out != input {
+		t.Errorf("Many $s parsed as %.20q..., %v", out, err)
+	}
+	if d := time.Since(start); d > 2*time.Second {
+		t.Errorf("Parsing %d bytes of $s took %v", len(input), d)
+	}
+}
+
+func TestMedia(t *testing.T) {
+	const iframe = `<iframe class="embed embed-youtube" src="https://www.youtube-nocookie.com/embed/dQw4w9WgXcQ?start=5"` +
+		` sandbox="allow-scripts allow-same-origin allow-presentation allow-popups"` +
+		` allow="fullscreen; encrypted-media; picture-in-picture" loading="lazy"></iframe>`
+
+	p := bbcode.NewParser(bbcode.DefaultTags())
+	p.Providers = append(media.Providers, media.FileHost("files", "files.example.com", media.Video))
+	tests := map[string]string{
+		"[youtube]https://youtu.be/dQw4w9WgXcQ?t=5[/youtube]": iframe,
+		"[video=https://youtu.be/dQw4w9WgXcQ?t=5]":            iframe,
+		"[video]https://files.example.com/a.webm[/video]":     `<video class="embed" src="https://files.example.com/a.webm" controls="" preload="metadata"></video>`,
+		"[audio]https://youtu.be/dQw4w9WgXcQ[/audio]":         `<a href="https://youtu.be/dQw4w9WgXcQ">https://youtu.be/dQw4w9WgXcQ</a>`,
+		`[video]https://evil.example/"x.mp4[/video]`:          "https://evil.example/&#34;x.mp4",
+		"[youtube]javascript:alert(1)[/youtube]":              "javascript:alert(1)",
+		// Links and embeds can't be inside links
+		"[url=http://a][youtube]https://x.com[/youtube][/url]":                `<a href="http://a">[youtube]https://x.com[/youtube]</a>`,
+		"[url=http://a][youtube]https://youtu.be/dQw4w9WgXcQ[/youtube][/url]": `<a href="http://a">[youtube]https://youtu.be/dQw4w9WgXcQ[/youtube]</a>`,
+	}
+	for input, expected := range tests {
+		out, err := p.Parse(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != expected {
+			t.Errorf("%q parsed as %q, expected %q", input, out, expected)
+		}
+		if err := htmlcheck.Check(out); err != nil {
+			t.Errorf("%q parsed as %q: %s", input, out, err)
+		}
+	}
+}
+
+func TestChannels(t *testing.T) {
+	channels := map[string]string{"general": "1", "off-topic": "2"}
+	p := bbcode.NewParser(bbcode.DefaultTags())
+	p.ResolveChannel = func(ctx context.Context, name string) (string, string, bool) {
+		id, ok := channels[name]
+		return id, "/channels/" + id, ok
+	}
+
+	tests := map[string]string{
+		"see #general":                `see <a class=" channel" href="/channels/1">#general</a>`,
+		"#off-topic, or #general.":    `<a class=" channel" href="/channels/2">#off-topic</a>, or <a class=" channel" href="/channels/1">#general</a>.`,
+		"C#general and #1":            "C#general and #1",
+		"#random":                     "#random",
+		"[code]#general[/code]":       "<pre><code>#general</code></pre>",
+		"[url=/x]#general[/url]":      `<a href="/x">#general</a>`,
+		"[#=general]x[/#]":            "[#=general]x[/#]",
+		"[b]in #general[/b] #general": `<b>in <a class=" channel" href="/channels/1">#general</a></b> <a class=" channel" href="/channels/1">#general</a>`,
+	}
+	for input, expected := range tests {
+		out, err := p.Parse(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != expected {
+			t.Errorf("%q parsed as %q, expected %q", input, out, expected)
+		}
+		if err := htmlcheck.Check(out); err != nil {
+			t.Errorf("%q parsed as %q: %s", input, out, err)
+		}
+	}
+
+	doc, err := p.ParseDocument("#off-topic #general #off-topic #random")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(doc.Channels) != "[2 1]" {
+		t.Errorf("Expected channels [2 1], got %v", doc.Channels)
+	}
+}
+
+func TestPreview(t *testing.T) {
+	p := bbcode.NewParser(bbcode.DefaultTags())
+	p.Preview = true
+	tests := map[string]struct {
+		out     string
+		pending string
+	}{
+		"[b]hello":           {`<span class="pending">[b]</span>hello`, "[b]"},
+		"[b]a [i]b[/i] [u]c": {`<span class="pending">[b]</span>a <i>b</i> <span class="pending">[u]</span>c`, "[b] [u]"},
+		"[list][*]a[*]b":     {`<span class="pending">[list]</span><span class="pending">[*]</span>a<span class="pending">[*]</span>b`, "[list] [*] [*]"},
+		"[code]x [b]y":       {`<span class="pending">[code]</span>x [b]y`, "[code]"},
+		"[color=red]abc":     {`<span class="pending">[color=red]</span>abc`, "[color]"},
+		"[quote]x[b]y[/b]":   {`<span class="pending">[quote]</span>x<b>y</b>`, "[quote]"},
+		"[b]done[/b]":        {"<b>done</b>", ""},
+	}
+	for input, expected := range tests {
+		doc, err := p.ParseDocument(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := p.RenderHTML(doc.Root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != expected.out {
+			t.Errorf("%q previewed as %q, expected %q", input, out, expected.out)
+		}
+		if err := htmlcheck.Check(out); err != nil {
+			t.Errorf("%q previewed as %q: %s", input, out, err)
+		}
+
+		pending := ""
+		for _, n := range doc.Pending() {
+			pending += " [" + n.Name + "]"
+		}
+		if pending != "" && pending[1:] != expected.pending || pending == "" && expected.pending != "" {
+			t.Errorf("%q would close %q, expected %q", input, pending, expected.pending)
+		}
+	}
+
+	doc, err := p.ParseDocument("[spoiler]secret")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if text := p.RenderText(doc.Root); text != "[spoiler]secret" {
+		t.Errorf("A pending spoiler's text is %q", text)
+	}
+
+	// Sent messages are still closed at the end of the input
+	if out, err := bbcode.NewParser(bbcode.DefaultTags()).Parse("[b]hello"); err != nil || out != "<b>hello</b>" {
+		t.Errorf("[b]hello parsed as %q, %v without Preview", out, err)
+	}
+}
+
+func TestMisnesting(t *testing.T) {
+	const misnested = "[b][i]x[/b]y[/i]"
+	if out, err := bbcode.Parse(misnested); err != nil || out != "<b><i>x</i></b>y[/i]" {
+		t.Errorf("%q parsed as %q, %v by default", misnested, out, err)
+	}
+
+	p := bbcode.NewParser(bbcode.DefaultTags())
+	p.Misnesting = bbcode.ReopenMisnested
+	tests := map[string]string{
+		misnested:                       "<b><i>x</i></b><i>y</i>",
+		"[b][i][u]x[/b]y[/i]z[/u]":      `<b><i><span class=" underline">x</span></i></b><i><span class=" underline">y</span></i><span class=" underline">z</span>`,
+		"[b][i]x[/b][/i]":               "<b><i>x</i></b>",
+		"[b][i]x[/b]":                   "<b><i>x</i></b>",
+		"[list][*]a[b]b[*]c[/b][/list]": "<ul><li>a<b>b</b></li><li><b>c</b></li></ul>",
+		"[color=red][i]x[/color]y[/i]":  `<span style="color: red;"><i>x</i></span><i>y</i>`,
+		"||a [b]b|| c[/b]":              `<span class="spoiler" role="button" tabindex="0" aria-expanded="false">a <b>b</b></span><b> c</b>`,
+		"[b][quote]x[/b]y[/quote]":      `<blockquote class="quote"><b>x</b></blockquote>y[/quote]`,
+	}
+	for input, expected := range tests {
+		doc, err := p.ParseDocument(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err := p.RenderHTML(doc.Root)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != expected {
+			t.Errorf("%q parsed as %q, expected %q", input, out, expected)
+		}
+		if err := htmlcheck.Check(out); err != nil {
+			t.Errorf("%q parsed as %q: %s", input, out, err)
+		}
+
+		var open []string
+		for _, tok := range doc.Root.Tokens() {
+			switch tok, _ := tok.(*token.TagToken); {
+			case tok == nil:
+			case tok.Kind == token.OpenToken:
+				open = append(open, tok.Name)
+			case tok.Kind == token.CloseToken:
+				if len(open) == 0 || open[len(open)-1] != tok.Name {
+					t.Errorf("The tokens of %q aren't nested properly", input)
+					break
+				}
+				open = open[:len(open)-1]
+			}
+		}
+	}
+}
+
+func TestEscapes(t *testing.T) {
+	const spoiler = `<span class="spoiler" role="button" tabindex="0" aria-expanded="false">`
+	p := bbcode.NewParser(bbcode.DefaultTags())
+	tests := map[string]string{
+		`\[b]x\[/b]`:                "[b]x[/b]",
+		`\\[b]x[/b]`:                `\<b>x</b>`,
+		`\\\[b]`:                    `\[b]`,
+		`a\b C:\\dir x\`:            `a\b C:\dir x\`,
+		`[code]\[b]\\[/code]`:       `<pre><code>\[b]\\</code></pre>`,
+		`||a\||b||`:                 spoiler + "a||b</span>",
+		`||a\||`:                    "||a||",
+		`\$5 and $x$`:               `$5 and <span class="math inline">x</span>`,
+		"[quote]\\[/quote][/quote]": `<blockquote class="quote">[/quote]</blockquote>`,
+		"```\n\\```\n```":           "<pre><code>\\</code></pre>\n```",
+		`[url=http://a]\[/url] [url=http://b]x[/url]`: `<a href="http://a"></a>[/url] <a href="http://b">x</a>`,
+		`[url=http://a]x\[/url] y[/url]`:              `<a href="http://a">x[/url] y</a>`,
+	}
+	for input, expected := range tests {
+		out, err := p.Parse(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != expected {
+			t.Errorf("%q parsed as %q, expected %q", input, out, expected)
+		}
+		if err := htmlcheck.Check(out); err != nil {
+			t.Errorf("%q parsed as %q, which is invalid: %s", input, out, err)
+		}
+	}
+
+	p.EscapeChar = 0
+	if out, err := p.Parse(`\[b]x[/b]`); err != nil || out != `\<b>x</b>` {
+		t.Errorf(`\[b]x[/b] parsed as %q, %v without escapes`, out, err)
+	}
+	p.EscapeChar = '!'
+	if out, err := p.Parse(`![b]x!![b]y`); err != nil || out != `[b]x!<b>y</b>` {
+		t.Errorf(`![b]x!![b]y parsed as %q, %v with ! as the escape character`, out, err)
+	}
+
+	// Escaped text parses back into the same text
+	p.EscapeChar = '\\'
+	pieces := []string{"[b]", "[/b]", "[code]", "[/code]", "||", "$", "```", "\\", "x", " ", "\n", "[", "]", "|"}
+	r := rand.New(rand.NewSource(1))
+	for i := 0; i < 1000; i++ {
+		text := ""
+		for j := r.Intn(10); j >= 0; j-- {
+			text += pieces[r.Intn(len(pieces))]
+		}
+		doc, err := p.ParseDocument(p.Escape(text))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out := p.RenderText(doc.Root); out != text {
+			t.Fatalf("%q was escaped as %q, which parsed as %q", text, p.Escape(text), out)
+		}
+	}
+}
+
+func TestTruncate(t *testing.T) {
+	p := bbcode.NewParser(bbcode.DefaultTags())
+	tests := []struct {
+		input    string
+		max      int
+		length   int
+		expected string
+	}{
+		{"[b]hello[/b] world", 20, 11, "<b>hello</b> world"},
+		{"[b]hello[/b] world", 4, 11, "<b>hel…</b>"},
+		{"[b]hello[/b] world", 6, 11, "<b>hello</b>…"},
+		{"[i]a [b]bc[/b] d[/i] e", 4, 8, "<i>a <b>b…</b></i>"},
+		{"a < b & c", 4, 9, "a &lt;…"},
+		{"été 👩‍💻👍🏽!", 6, 7, "été 👩‍💻…"},
+		{"🇯🇵🇫🇷🇩🇪", 2, 3, "🇯🇵…"},
+		{"ab[img]x.png[/img]cd", 4, 5, `ab<img src="x.png" title="x.png">…`},
+		{"ab[img]x.png[/img]cd", 3, 5, "ab…"},
+		{"[list][*]one[*]two[/list]", 5, 6, `<ul><li>one</li><li>t…</li></ul>`},
+		{"abc", 0, 3, ""},
+		{"[b]abc[/b]", -1, 3, ""},
+	}
+	for _, test := range tests {
+		doc, err := p.ParseDocument(test.input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if length := p.Length(doc.Root); length != test.length {
+			t.Errorf("%q has length %d, expected %d", test.input, length, test.length)
+		}
+		cut := p.Truncate(doc.Root, test.max)
+		if length := p.Length(cut); length > test.max && length > 0 {
+			t.Errorf("%q cut to %d has length %d", test.input, test.max, length)
+		}
+		out, err := p.RenderHTML(cut)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != test.expected {
+			t.Errorf("%q cut to %d rendered as %q, expected %q", test.input, test.max, out, test.expected)
+		}
+	}
+
+	doc, err := p.ParseDocument("[b]hello[/b] world")
+	if err != nil {
+		t.Fatal(err)
+	}
+	p.Truncate(doc.Root, 3)
+	if out, _ := p.RenderHTML(doc.Root); out != "<b>hello</b> world" {
+		t.Errorf("Truncating changed the document to %q", out)
+	}
+	if text := p.RenderNotification(doc.Root, 3); text != "he…" {
+		t.Errorf("Notification cut to %q", text)
+	}
+}
+
+func TestLinks(t *testing.T) {
+	p := bbcode.NewParser(bbcode.DefaultTags())
+	p.MessageURL = func(ctx context.Context, id string) string { return "/messages/" + id }
+	p.ResolveChannel = func(ctx context.Context, name string) (string, string, bool) {
+		return "1", "/channels/1", name == "general"
+	}
+
+	doc, err := p.ParseDocument("[url=https://a.test]x[/url] [img]https://b.test/p.png[/img] [url]javascript:alert(1)[/url]" +
+		" [code][url]https://c.test[/url][/code] [noparse][img]https://d.test[/img][/noparse] https://e.test" +
+		" [youtube]https://youtu.be/dQw4w9WgXcQ[/youtube] [audio]https://youtu.be/x[/audio] #general [quote msg=5]hi[/quote]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	links := ""
+	for _, link := range doc.Links {
+		links += fmt.Sprintf("%s %s %d-%d %t\n", link.Kind, link.URL, link.Span.Start, link.Span.End, link.Auto)
+	}
+	expected := "link https://a.test 0-27 false\n" +
+		"image https://b.test/p.png 28-59 false\n" +
+		"media https://www.youtube-nocookie.com/embed/dQw4w9WgXcQ 190-237 false\n" +
+		"link https://youtu.be/x 238-271 false\n" +
+		"link /channels/1 272-280 true\n" +
+		"link /messages/5 281-304 true\n"
+	if links != expected {
+		t.Errorf("Expected links\n%s\ngot\n%s", expected, links)
+	}
+
+	// URLs from resolvers are filtered like the ones in tags
+	p.MessageURL = func(ctx context.Context, id string) string { return "javascript:alert(1)" }
+	p.ResolveChannel = func(ctx context.Context, name string) (string, string, bool) {
+		return "1", "javascript:alert(2)", true
+	}
+	if doc, err := p.ParseDocument("#general [quote msg=5]hi[/quote]"); err != nil || len(doc.Links) != 0 {
+		t.Errorf("Links with javascript: URLs from resolvers gave %+v, %v", doc, err)
+	}
+}
+
+func TestImageProxy(t *testing.T) {
+	proxy := imageproxy.New("https://proxy.test", []byte("key"))
+	p := bbcode.NewParser(bbcode.DefaultTags())
+	p.RewriteImage = proxy.RewriteImage
+
+	doc, err := p.ParseDocument("[img]http://x.test/a.png[/img] [img=/local.png]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	proxied := proxy.Rewrite("http://x.test/a.png")
+	out, err := p.RenderHTML(doc.Root)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `<img src="` + proxied + `" title="http://x.test/a.png"> <img src="/local.png">`; out != expected {
+		t.Errorf("Images rendered as %q, expected %q", out, expected)
+	}
+	if len(doc.Links) != 2 || doc.Links[0].URL != "http://x.test/a.png" || doc.Links[0].Proxy != proxied ||
+		doc.Links[1].URL != "/local.png" || doc.Links[1].Proxy != "" {
+		t.Errorf("Unexpected links %+v", doc.Links)
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	p := bbcode.NewParser(bbcode.DefaultTags())
+	members := permission.Deny("color", "colour", "size", "h1", "youtube", "video", "audio", "||")
+	stripped := permission.Deny("color", "colour", "size", "h1", "youtube", "video", "audio", "||")
+	stripped.Denied = permission.Strip
+
+	tests := []struct {
+		input, literal, strip string
+	}{
+		{"[b]x[/b] [color=red]y[/color]", "<b>x</b> [color=red]y[/color]", "<b>x</b> y"},
+		{"[colour=red][b]y[/b][/colour]", "[colour=red]<b>y</b>[/colour]", "<b>y</b>"},
+		{"[color=red]y", "[color=red]y", "y"},
+		{"[youtube]https://youtu.be/dQw4w9WgXcQ[/youtube]", "[youtube]https://youtu.be/dQw4w9WgXcQ[/youtube]", "https://youtu.be/dQw4w9WgXcQ"},
+		{"a ||b [i]c[/i]|| d || e", "a ||b <i>c</i>|| d || e", "a b <i>c</i> d || e"},
+		{`\[color=red]`, "[color=red]", "[color=red]"},
+	}
+	for _, test := range tests {
+		if out, err := p.ParseWith(test.input, members); err != nil || out != test.literal {
+			t.Errorf("%q parsed as %q, %v, expected %q", test.input, out, err, test.literal)
+		}
+		if out, err := p.ParseWith(test.input, stripped); err != nil || out != test.strip {
+			t.Errorf("%q parsed as %q, %v when stripping, expected %q", test.input, out, err, test.strip)
+		}
+	}
+
+	if out, err := bbcode.ParseWith("[b]x[/b] [i]y[/i]", permission.Allow("b")); err != nil || out != "<b>x</b> [i]y[/i]" {
+		t.Errorf("Only allowing [b] gave %q, %v", out, err)
+	}
+	// Aliases are denied along with the tags they are names for
+	colors := permission.Deny("color", "math", "spoiler")
+	input := "[colour=red]x[/colour] [tex]y[/tex] $z$ ||w||"
+	if out, err := p.ParseWith(input, colors); err != nil || out != input {
+		t.Errorf("Denying the tags aliases are names for gave %q, %v", out, err)
+	}
+	colors.Names["colour"] = true
+	if out, err := p.ParseWith("[colour=red]x[/colour]", colors); err != nil || out != `<span style="color: red;">x</span>` {
+		t.Errorf("Allowing an alias by name gave %q, %v", out, err)
+	}
+
+	doc, err := p.ParseDocumentWith("[h1]x[/h1]", members)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if fmt.Sprint(doc.Diagnostics) != "[0-4: [h1] isn't allowed 5-10: [/h1] isn't allowed]" {
+		t.Errorf("Unexpected diagnostics %v", doc.Diagnostics)
+	}
+}
+
+func TestContext(t *testing.T) {
+	rooms := map[string]map[string]string{"1": {"general": "10"}, "2": {"general": "20"}}
+	p := bbcode.NewParser(bbcode.DefaultTags())
+	p.ResolveChannel = func(ctx context.Context, name string) (string, string, bool) {
+		id, ok := rooms[parsectx.Room(ctx)][name]
+		return id, "/channels/" + id, ok
+	}
+	p.MessageURL = func(ctx context.Context, id string) string {
+		return "/rooms/" + parsectx.Room(ctx) + "/messages/" + id
+	}
+
+	ctx := parsectx.WithRoom(context.Background(), "2")
+	out, err := p.ParseContext(ctx, "#general [quote msg=5]hi[/quote]")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `<a class=" channel" href="/channels/20">#general</a> <blockquote class="quote"><cite>` +
+		`<a href="/rooms/2/messages/5">Quoted message</a></cite>hi</blockquote>`; out != expected {
+		t.Errorf("Parsed as %q, expected %q", out, expected)
+	}
+	if out, err := p.ParseContext(parsectx.WithRoom(ctx, "3"), "#general"); err != nil || out != "#general" {
+		t.Errorf("#general in a room without it parsed as %q, %v", out, err)
+	}
+
+	ctx = parsectx.WithPermissions(ctx, permission.Deny("b"))
+	if out, err := p.ParseContext(ctx, "[b]x[/b] [i]y[/i]"); err != nil || out != "[b]x[/b] <i>y</i>" {
+		t.Errorf("Denying [b] in the context gave %q, %v", out, err)
+	}
+
+	p.Newlines, p.Preview = bbcode.Paragraphs, true
+	p.MessageURL = func(ctx context.Context, id string) string {
+		if opts, ok := parsectx.ParseOptions(ctx); !ok || opts.Newlines != "p" || !opts.Preview || opts.Misnesting != "close" {
+			t.Errorf("The options in the context are %+v, %v", opts, ok)
+		}
+		return ""
+	}
+	if _, err := p.ParseContext(ctx, "[quote msg=5]hi[/quote]"); err != nil {
+		t.Error(err)
+	}
+
+	p.MessageURL = func(ctx context.Context, id string) string {
+		return "javascript:alert(1)"
+	}
+	tests := map[string]string{
+		"[quote msg=5]hi[/quote]":          `<blockquote class="quote">hi</blockquote>`,
+		"[quote name=amy msg=5]hi[/quote]": `<blockquote class="quote"><cite>amy</cite>hi</blockquote>`,
+	}
+	for input, expected := range tests {
+		if out, err := p.ParseContext(ctx, input); err != nil || out != expected {
+			t.Errorf("%q with a javascript: message URL parsed as %q, %v", input, out, err)
+		}
+	}
+
+	ctx, cancel := context.WithCancel(ctx)
+	cancel()
+	if doc, err := p.ParseDocumentContext(ctx, "[i]y[/i]"); err != context.Canceled || doc != nil {
+		t.Errorf("Parsing in a cancelled context gave %v, %v", doc, err)
+	}
+}
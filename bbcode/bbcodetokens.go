@@ -1,18 +1,75 @@
 package bbcode
 
 import (
+	"context"
+	"github.com/moechat/parser/ast"
+	"github.com/moechat/parser/media"
 	"github.com/moechat/parser/token"
+	"html"
+	"regexp"
+	"strconv"
+	"strings"
+	"unicode"
+	"unicode/utf8"
 )
 
 // A type that determines what the parser will replace tags it finds with. The Attributes and CssProps are maps that assign a regexp parser group
 type HtmlTags struct {
-	Options      int                   // Compatibility options for BBCode until token parsing is complete
-	Tags         []string              // HTML tags
-	Classes      [][]string            // Classes to give to the HTML elements
-	Attributes   []map[int8]string     // HTML tag attributes
-	CssProps     []map[int8]string     // CSS Properties
-	OutputFunc   func([]string) string // A custom output function; this returns the string to emplace into the HTML.
-	InputModFunc func(*[]string)       // A function that takes input and returns input modified (an example use case would be converting a username to a user ID in @tagging)
+	Options      int                                       // Compatibility options for BBCode until token parsing is complete
+	Tags         []string                                  // HTML tags
+	Classes      [][]string                                // Classes to give to the HTML elements
+	Attributes   []map[int8]string                         // HTML tag attributes
+	CssProps     []map[int8]string                         // CSS Properties
+	OutputFunc   func([]string) string                     // A custom output function; this returns the string to emplace into the HTML.
+	CloseFunc    func([]string) string                     // A custom output function for the end of the tag, for use with OutputFunc
+	InputModFunc func(*[]string)                           // A function that takes input and returns input modified (an example use case would be converting a username to a user ID in @tagging)
+	ArgValidFunc func([]string) bool                       // Returns whether the (modified) input is valid; the tag is output as text if it isn't
+	ResolveFunc  func(context.Context, *Parser, *[]string) // Like InputModFunc, but given the Parser and the context the message is parsed in so it can use its resolvers (i.e. MessageURL)
+	// Returns the URLs an element with the (resolved) args renders, for Document.Links. If nil, they
+	// are the args of href and src Attributes, unless the tag has an OutputFunc. Either way, URLs with
+	// a scheme other than http, https or mailto are left out.
+	LinkFunc func([]string) []ast.Link
+
+	// Maps the names of args given as [tag name=value other="value"] to their positions in the args
+	NamedArgs map[string]int8
+	// If set, the tag's name is a delimiter written on both sides of its body, like ||spoiler||, instead of a BBCode tag
+	Symmetric bool
+	// If set, RenderText outputs this instead of the tag's contents (i.e. so spoilers aren't leaked in notifications)
+	TextMask string
+	// For Symmetric tags, whether a word on the same line as the opening delimiter is the first arg (i.e. ```go)
+	ArgLine bool
+	// For Symmetric tags, returns whether body can be the tag's body when it is followed by the closing
+	// delimiter and then rest. If not, the opening delimiter is left as text (i.e. so "$5 and $10" isn't math).
+	BodyValidFunc func(body, rest string) bool
+	// Whether the tag's body is code in the language given by its first arg, which is highlighted by Parser.Highlight
+	Code bool
+	// Whether newlines in the tag's body are left alone whatever the Parser's NewlineMode is (i.e. in [pre])
+	KeepNewlines bool
+	// Whether the tag outputs a block element, so it is kept out of paragraphs
+	Block bool
+	// Whether the tag is a Block that may only hold inline content (i.e. headings), so it is split
+	// around the blocks inside it like an inline tag
+	PhrasingOnly bool
+	// Whether the tag is left as text inside a link, since it outputs a link or an embed (i.e. [youtube])
+	NotInLinks bool
+	// If set, the name of the tag this one is another name for (i.e. colour for color), which
+	// permission.Sets check in its place
+	Alias string
+
+	// If set, the tag is only recognized inside one of these tags, and opening it implicitly
+	// closes every tag opened since the innermost one (i.e. [*] closes the previous [*] in a [list]).
+	Parents []string
+	// If set, only these tags may be direct children of the tag. Whitespace between them is
+	// dropped, and any other content is wrapped in the first of these tags.
+	Children []string
+	// If positive, children after the first MaxChildren are dropped (i.e. to limit the size of tables)
+	MaxChildren int
+	// If positive, the contents of the tag are replaced with "…" when it is nested inside more
+	// than MaxDepth-1 tags with the same name (i.e. to stop quote pyramids)
+	MaxDepth int
+	// Whether an element of the tag counts as a single visible unit, like a character, when
+	// a message is measured or truncated, and is kept whole (i.e. images and embeds)
+	Unit bool
 }
 
 var bbCodeTags = map[string]HtmlTags{
@@ -22,8 +79,30 @@ var bbCodeTags = map[string]HtmlTags{
 		Tags:    []string{"span"},
 		Classes: [][]string{{"underline"}},
 	},
-	"pre":  {Options: token.NoParseInner, Tags: []string{"pre"}},
-	"code": {Options: token.NoParseInner, Tags: []string{"pre", "code"}},
+	"pre": {
+		Options:      token.NoParseInner,
+		Tags:         []string{"pre"},
+		KeepNewlines: true,
+		Block:        true,
+	},
+	"code": {
+		Options:      token.NoParseInner,
+		Tags:         []string{"pre", "code"},
+		OutputFunc:   openCode,
+		Code:         true,
+		KeepNewlines: true,
+		Block:        true,
+	},
+	"```": {
+		Options:      token.NoParseInner,
+		Tags:         []string{"pre", "code"},
+		OutputFunc:   openCode,
+		Symmetric:    true,
+		ArgLine:      true,
+		Code:         true,
+		KeepNewlines: true,
+		Block:        true,
+	},
 	"color": {
 		Tags:     []string{"span"},
 		CssProps: []map[int8]string{{0: "color"}},
@@ -31,6 +110,7 @@ var bbCodeTags = map[string]HtmlTags{
 	"colour": {
 		Tags:     []string{"span"},
 		CssProps: []map[int8]string{{0: "color"}},
+		Alias:    "color",
 	},
 	"size": {
 		Options:  token.NumberArgToPx,
@@ -48,12 +128,380 @@ var bbCodeTags = map[string]HtmlTags{
 			token.TokenBodyAsArg |
 			token.PossibleSingle |
 			token.HtmlSingle),
-		Tags:       []string{"img"},
-		Attributes: []map[int8]string{{0: "src", 1: "title"}},
+		Tags:        []string{"img"},
+		Attributes:  []map[int8]string{{imgSrc: "src", imgTitle: "title"}},
+		ResolveFunc: resolveImage,
+		LinkFunc:    imageLinks,
+		Unit:        true,
+	},
+	"h1":      {Tags: []string{"h1"}, Block: true, PhrasingOnly: true},
+	"h2":      {Tags: []string{"h2"}, Block: true, PhrasingOnly: true},
+	"h3":      {Tags: []string{"h3"}, Block: true, PhrasingOnly: true},
+	"center":  {Tags: []string{"div"}, Classes: [][]string{{"align-center"}}, Block: true},
+	"left":    {Tags: []string{"div"}, Classes: [][]string{{"align-left"}}, Block: true},
+	"right":   {Tags: []string{"div"}, Classes: [][]string{{"align-right"}}, Block: true},
+	"justify": {Tags: []string{"div"}, Classes: [][]string{{"align-justify"}}, Block: true},
+	"hr":      {Options: token.HtmlSingle, Tags: []string{"hr"}, Block: true, Unit: true},
+	"#": {
+		Tags:       []string{"a"},
+		Classes:    [][]string{{"channel"}},
+		Attributes: []map[int8]string{{2: "href"}},
+		// Channel links are made by Parser.ResolveChannel, not written as [#]
+		ArgValidFunc: func(args []string) bool { return len(args) > 2 && args[2] != "" },
+		LinkFunc: func(args []string) []ast.Link {
+			return []ast.Link{{URL: argAt(args, 2), Kind: ast.Hyperlink, Auto: true}}
+		},
+	},
+	"youtube": mediaTag(func(pr *media.Provider) bool { return pr.Name == "youtube" }),
+	"video":   mediaTag(func(pr *media.Provider) bool { return pr.Kind == media.Video }),
+	"audio":   mediaTag(func(pr *media.Provider) bool { return pr.Kind == media.Audio }),
+	"math": {
+		Options:      token.NoParseInner,
+		Tags:         []string{"span"},
+		OutputFunc:   openMath,
+		KeepNewlines: true,
+	},
+	"tex": {
+		Options:      token.NoParseInner,
+		Tags:         []string{"span"},
+		OutputFunc:   openMath,
+		KeepNewlines: true,
+		Alias:        "math",
+	},
+	"$": {
+		Options:       token.NoParseInner,
+		Tags:          []string{"span"},
+		OutputFunc:    func([]string) string { return `<span class="math inline">` },
+		Symmetric:     true,
+		BodyValidFunc: validInlineMath,
+		KeepNewlines:  true,
+		Alias:         "math",
+	},
+	"$$": {
+		Options:      token.NoParseInner,
+		Tags:         []string{"span"},
+		OutputFunc:   func([]string) string { return `<span class="math display">` },
+		Symmetric:    true,
+		KeepNewlines: true,
+		Alias:        "math",
 	},
 	"s":    {Tags: []string{"s"}},
 	"samp": {Tags: []string{"samp"}},
 	"q":    {Tags: []string{"q"}},
+	"list": {
+		Tags:       []string{"ul"},
+		OutputFunc: openList,
+		CloseFunc:  closeList,
+		Children:   []string{"*"},
+		Block:      true,
+	},
+	"*": {
+		Tags:    []string{"li"},
+		Parents: []string{"list"},
+		Block:   true,
+	},
+	"table": {
+		Tags:        []string{"table"},
+		Children:    []string{"tr"},
+		MaxChildren: 100,
+		Block:       true,
+	},
+	"tr": {
+		Tags:        []string{"tr"},
+		Parents:     []string{"table"},
+		Children:    []string{"td", "th"},
+		MaxChildren: 20,
+		Block:       true,
+	},
+	"td": {Tags: []string{"td"}, Parents: []string{"tr"}, Block: true},
+	"th": {Tags: []string{"th"}, Parents: []string{"tr"}, Block: true},
+	"quote": {
+		Tags:        []string{"blockquote"},
+		OutputFunc:  openQuote,
+		CloseFunc:   closeQuote,
+		ResolveFunc: resolveQuote,
+		LinkFunc:    quoteLinks,
+		NamedArgs:   map[string]int8{"name": 0, "msg": 1},
+		MaxDepth:    3,
+		Block:       true,
+	},
+	"spoiler": {
+		Tags:       []string{"details"},
+		OutputFunc: openSpoiler,
+		CloseFunc:  closeSpoiler,
+		TextMask:   "(spoiler)",
+		Block:      true,
+	},
+	"||": {
+		Tags: []string{"span"},
+		OutputFunc: func([]string) string {
+			return `<span class="spoiler" role="button" tabindex="0" aria-expanded="false">`
+		},
+		Symmetric: true,
+		TextMask:  "(spoiler)",
+		Alias:     "spoiler",
+	},
+}
+
+// listType returns the type attribute of an ordered list, or "" for an unordered list.
+func listType(args []string) string {
+	if len(args) == 0 {
+		return ""
+	}
+	switch args[0] {
+	case "1", "a", "A", "i", "I":
+		return args[0]
+	}
+	return ""
+}
+
+func openList(args []string) string {
+	if t := listType(args); t != "" {
+		return `<ol type="` + t + `">`
+	}
+	return "<ul>"
+}
+
+func closeList(args []string) string {
+	if listType(args) != "" {
+		return "</ol>"
+	}
+	return "</ul>"
+}
+
+var languageRe = regexp.MustCompile(`^[A-Za-z0-9_+#.-]{1,32}$`)
+
+// openCode opens a code block, with a language-* class if its first arg is a language name.
+func openCode(args []string) string {
+	if len(args) == 0 || !languageRe.MatchString(args[0]) {
+		return "<pre><code>"
+	}
+	return `<pre><code class="language-` + strings.ToLower(args[0]) + `">`
+}
+
+// openMath opens [math] and [tex], which are inline unless their arg is "display".
+func openMath(args []string) string {
+	if len(args) != 0 && args[0] == "display" {
+		return `<span class="math display">`
+	}
+	return `<span class="math inline">`
+}
+
+// validInlineMath returns whether $body$ is math. Like in pandoc, the body can't start or end with
+// whitespace, and the closing $ can't be followed by a digit, so in "costs $5, or $x$ each" only x is math.
+func validInlineMath(body, rest string) bool {
+	if body == "" {
+		return false
+	}
+	first, _ := utf8.DecodeRuneInString(body)
+	last, _ := utf8.DecodeLastRuneInString(body)
+	next, _ := utf8.DecodeRuneInString(rest)
+	return !unicode.IsSpace(first) && !unicode.IsSpace(last) && !unicode.IsDigit(next)
+}
+
+// The args of [img]: the URL to load the image from, its title, which is the body of the tag, and
+// its original URL if the Parser's RewriteImage changed it.
+const (
+	imgSrc = iota
+	imgTitle
+	imgURL
+)
+
+func resolveImage(ctx context.Context, p *Parser, args *[]string) {
+	link := argAt(*args, imgSrc)
+	if link == "" || p.RewriteImage == nil {
+		return
+	}
+	if src := p.RewriteImage(ctx, link); src != link {
+		for len(*args) <= imgURL {
+			*args = append(*args, "")
+		}
+		(*args)[imgSrc] = src
+		(*args)[imgURL] = link
+	}
+}
+
+func imageLinks(args []string) []ast.Link {
+	src := argAt(args, imgSrc)
+	if src == "" || !safeScheme(src) {
+		return nil
+	}
+	if link := argAt(args, imgURL); link != "" {
+		return []ast.Link{{URL: link, Kind: ast.Image, Proxy: src}}
+	}
+	return []ast.Link{{URL: src, Kind: ast.Image}}
+}
+
+// The args of media tags. All but the first two are set by resolveMedia if the URL can be embedded.
+const (
+	mediaURL      = iota
+	mediaBody     // The body of the tag, which is also the URL if it isn't given as an arg
+	mediaSrc      // The URL to embed
+	mediaElement  // iframe, video or audio
+	mediaProvider // The name of the media.Provider
+	mediaID       // The ID of the media
+	mediaStart    // The time to start playing at, in seconds
+)
+
+// mediaTag returns the tag for embedding media from the providers for which use returns true.
+func mediaTag(use func(*media.Provider) bool) HtmlTags {
+	return HtmlTags{
+		Options:     token.AllowTokenBodyAsFirstArg | token.TokenBodyAsArg | token.PossibleSingle,
+		Tags:        []string{"iframe"},
+		ResolveFunc: func(ctx context.Context, p *Parser, args *[]string) { resolveMedia(p, args, use) },
+		OutputFunc:  openMedia,
+		CloseFunc:   closeMedia,
+		LinkFunc:    mediaLinks,
+		Unit:        true,
+		NotInLinks:  true,
+	}
+}
+
+func resolveMedia(p *Parser, args *[]string, use func(*media.Provider) bool) {
+	for len(*args) <= mediaStart {
+		*args = append(*args, "")
+	}
+	providers := p.Providers
+	if providers == nil {
+		providers = media.Providers
+	}
+
+	e := media.Find(providers, strings.TrimSpace((*args)[mediaURL]), use)
+	if e == nil {
+		return
+	}
+	element := e.Provider.Kind.String()
+	if e.Provider.Iframe {
+		element = "iframe"
+	}
+	(*args)[mediaSrc] = e.Src
+	(*args)[mediaElement] = element
+	(*args)[mediaProvider] = e.Provider.Name
+	(*args)[mediaID] = e.ID
+	(*args)[mediaStart] = strconv.Itoa(e.Start)
+}
+
+var linkRe = regexp.MustCompile(`^(?i:https?://)[^\s"'<>]+$`)
+
+// openMedia embeds media resolved by resolveMedia. URLs that couldn't be resolved are linked to instead.
+func openMedia(args []string) string {
+	src := html.EscapeString(argAt(args, mediaSrc))
+	switch element := argAt(args, mediaElement); element {
+	case "iframe":
+		return `<iframe class="embed embed-` + html.EscapeString(argAt(args, mediaProvider)) + `" src="` + src +
+			`" sandbox="allow-scripts allow-same-origin allow-presentation allow-popups"` +
+			` allow="fullscreen; encrypted-media; picture-in-picture" loading="lazy">`
+	case "video", "audio":
+		return "<" + element + ` class="embed" src="` + src + `" controls="" preload="metadata">`
+	}
+
+	link := strings.TrimSpace(argAt(args, mediaURL))
+	if linkRe.MatchString(link) {
+		return `<a href="` + html.EscapeString(link) + `">` + html.EscapeString(link)
+	}
+	return html.EscapeString(link)
+}
+
+func mediaLinks(args []string) []ast.Link {
+	if src := argAt(args, mediaSrc); src != "" {
+		return []ast.Link{{URL: src, Kind: ast.Media}}
+	}
+	if link := strings.TrimSpace(argAt(args, mediaURL)); linkRe.MatchString(link) {
+		return []ast.Link{{URL: link, Kind: ast.Hyperlink}}
+	}
+	return nil
+}
+
+func closeMedia(args []string) string {
+	if element := argAt(args, mediaElement); element != "" {
+		return "</" + element + ">"
+	}
+	if linkRe.MatchString(strings.TrimSpace(argAt(args, mediaURL))) {
+		return "</a>"
+	}
+	return ""
+}
+
+// argAt returns args[i], or "" if there is no such arg.
+func argAt(args []string, i int) string {
+	if i < len(args) {
+		return args[i]
+	}
+	return ""
+}
+
+// The args of [quote]: the author, the ID of the quoted message and the URL of that message, which is set by resolveQuote.
+const (
+	quoteName = iota
+	quoteMsg
+	quoteURL
+)
+
+func resolveQuote(ctx context.Context, p *Parser, args *[]string) {
+	for len(*args) <= quoteURL {
+		*args = append(*args, "")
+	}
+	if id := (*args)[quoteMsg]; id != "" && p.MessageURL != nil {
+		(*args)[quoteURL] = p.MessageURL(ctx, id)
+	}
+}
+
+// quoteLinks returns the link to the quoted message, which is made from its ID.
+func quoteLinks(args []string) []ast.Link {
+	if url := argAt(args, quoteURL); url != "" {
+		return []ast.Link{{URL: url, Kind: ast.Hyperlink, Auto: true}}
+	}
+	return nil
+}
+
+func openQuote(args []string) string {
+	name, url := "", ""
+	if len(args) > quoteURL {
+		name, url = args[quoteName], args[quoteURL]
+	} else if len(args) > quoteName {
+		name = args[quoteName]
+	}
+	if !safeScheme(url) {
+		// The URL is only escaped, so a javascript: one from MessageURL would be linked to as it is
+		url = ""
+	}
+	if name == "" && url == "" {
+		return `<blockquote class="quote">`
+	}
+
+	cite := html.EscapeString(name)
+	if url != "" {
+		if cite == "" {
+			cite = "Quoted message"
+		}
+		cite = `<a href="` + html.EscapeString(url) + `">` + cite + "</a>"
+	}
+	return `<blockquote class="quote"><cite>` + cite + "</cite>"
+}
+
+func closeQuote(args []string) string {
+	return "</blockquote>"
+}
+
+func openSpoiler(args []string) string {
+	title := "Spoiler"
+	if len(args) > 0 && args[0] != "" {
+		title = html.EscapeString(args[0])
+	}
+	return `<details class="spoiler"><summary>` + title + "</summary>"
+}
+
+func closeSpoiler(args []string) string {
+	return "</details>"
+}
+
+// DefaultTags returns a copy of the tags used by Parse, which can be modified and passed to NewParser.
+func DefaultTags() map[string]HtmlTags {
+	tags := make(map[string]HtmlTags, len(bbCodeTags))
+	for name, htmlTags := range bbCodeTags {
+		tags[name] = htmlTags
+	}
+	return tags
 }
 
 // One can insert use-case specific BBCode tags by using this function.
@@ -64,4 +512,5 @@ var bbCodeTags = map[string]HtmlTags{
 // This will be deprecated in the future after BBCode functionality is added to AddMatcher.
 func AddBbToken(name string, htmlTags HtmlTags) {
 	bbCodeTags[name] = htmlTags
+	defaultParser = NewParser(bbCodeTags)
 }
@@ -0,0 +1,284 @@
+/*
+ * Command moeparse parses messages and prints how they render.
+ *
+ * Usage:
+ *
+ *	moeparse [flags] [file ...]
+ *
+ * Each file is parsed as one message; with no files, stdin is read instead.
+ * With -lines, every line of the input is parsed as a separate message, which
+ * is useful for re-rendering messages in bulk.
+ *
+ * The flags are:
+ *
+ *	-ruleset file  Use the tags in a .json or .toml ruleset instead of the built-in BBCode tags
+ *	-format f      The output format: html, text, tokens, json or diagnostics (default html)
+ *	-lines         Parse each line of the input as a separate message
+ *	-strict        Treat diagnostics as errors, and don't output the messages that have any
+ *	-check         Check that the HTML output is well-formed and safe using htmlcheck
+ *	-highlight     Highlight code blocks using the highlight package
+ *	-newlines m    How to render newlines: preserve, br or p (default preserve)
+ *	-misnesting m  How to repair misnested tags: close or reopen (default close)
+ *	-preview       Parse the input as a preview of a message that is still being typed,
+ *	               and print the tags that would be closed automatically to stderr
+ *	-allow tags    Only allow the tags in a comma-separated list
+ *	-deny tags     Allow every tag except the ones in a comma-separated list
+ *	-strip         Remove the tags that aren't allowed instead of leaving them as text
+ *
+ * moeparse exits with status 1 if any message fails to parse (or, with -strict,
+ * has diagnostics) and 2 if it is used incorrectly.
+ */
+package main
+
+import (
+	"bufio"
+	"encoding/json"
+	"flag"
+	"fmt"
+	"github.com/moechat/parser/ast"
+	"github.com/moechat/parser/bbcode"
+	"github.com/moechat/parser/highlight"
+	"github.com/moechat/parser/htmlcheck"
+	"github.com/moechat/parser/permission"
+	"github.com/moechat/parser/ruleset"
+	"github.com/moechat/parser/token"
+	"io"
+	"io/ioutil"
+	"os"
+	"strings"
+)
+
+var (
+	rulesetFile = flag.String("ruleset", "", "a .json or .toml ruleset to use instead of the built-in tags")
+	format      = flag.String("format", "html", "the output format: html, text, tokens, json or diagnostics")
+	lines       = flag.Bool("lines", false, "parse each line of the input as a separate message")
+	strict      = flag.Bool("strict", false, "treat diagnostics as errors")
+	check       = flag.Bool("check", false, "check that the HTML output is well-formed and safe")
+	highlightOn = flag.Bool("highlight", false, "highlight code blocks")
+	newlines    = flag.String("newlines", "preserve", "how to render newlines: preserve, br or p")
+	misnesting  = flag.String("misnesting", "close", "how to repair misnested tags: close or reopen")
+	preview     = flag.Bool("preview", false, "parse the input as a preview, and print the tags that would be closed automatically")
+	allow       = flag.String("allow", "", "a comma-separated list of the only tags to allow")
+	deny        = flag.String("deny", "", "a comma-separated list of tags not to allow")
+	strip       = flag.Bool("strip", false, "remove the tags that aren't allowed instead of leaving them as text")
+)
+
+var newlineModes = map[string]bbcode.NewlineMode{
+	"preserve": bbcode.PreserveNewlines,
+	"br":       bbcode.BreakNewlines,
+	"p":        bbcode.Paragraphs,
+}
+
+var misnestModes = map[string]bbcode.MisnestMode{
+	"close":  bbcode.CloseMisnested,
+	"reopen": bbcode.ReopenMisnested,
+}
+
+var formatters = map[string]func(p *bbcode.Parser, doc *ast.Document, w io.Writer) error{
+	"html": func(p *bbcode.Parser, doc *ast.Document, w io.Writer) error {
+		out, err := p.RenderHTML(doc.Root)
+		if err == nil && p.CheckOutput != nil {
+			err = p.CheckOutput(out)
+		}
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, out)
+		return err
+	},
+	"text": func(p *bbcode.Parser, doc *ast.Document, w io.Writer) error {
+		_, err := fmt.Fprintln(w, p.RenderText(doc.Root))
+		return err
+	},
+	"tokens": func(p *bbcode.Parser, doc *ast.Document, w io.Writer) error {
+		for _, t := range doc.Root.Tokens() {
+			if _, err := fmt.Fprintln(w, formatToken(t)); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+	"json": func(p *bbcode.Parser, doc *ast.Document, w io.Writer) error {
+		out, err := json.MarshalIndent(doc, "", "  ")
+		if err != nil {
+			return err
+		}
+		_, err = fmt.Fprintln(w, string(out))
+		return err
+	},
+	"diagnostics": func(p *bbcode.Parser, doc *ast.Document, w io.Writer) error {
+		for _, d := range doc.Diagnostics {
+			if _, err := fmt.Fprintln(w, d); err != nil {
+				return err
+			}
+		}
+		return nil
+	},
+}
+
+func formatToken(t token.Token) string {
+	switch t := t.(type) {
+	case *token.TextToken:
+		text, _ := t.Output()
+		return fmt.Sprintf("TEXT %q", text)
+	case *token.TagToken:
+		kind := map[int]string{token.SingleToken: "SINGLE", token.OpenToken: "OPEN", token.CloseToken: "CLOSE"}[t.Kind]
+		if t.Kind == token.CloseToken {
+			return kind + " " + t.Name
+		}
+		return fmt.Sprintf("%s %s %q", kind, t.Name, t.Args)
+	}
+	return t.Type()
+}
+
+// A message is a single input to parse, along with where it came from for error messages.
+type message struct {
+	source string
+	body   string
+}
+
+func readMessages(name string, r io.Reader) ([]message, error) {
+	if !*lines {
+		body, err := ioutil.ReadAll(r)
+		if err != nil {
+			return nil, err
+		}
+		return []message{{name, string(body)}}, nil
+	}
+
+	var ret []message
+	scanner := bufio.NewScanner(r)
+	scanner.Buffer(nil, 1<<24)
+	for n := 1; scanner.Scan(); n++ {
+		ret = append(ret, message{fmt.Sprintf("%s:%d", name, n), scanner.Text()})
+	}
+	return ret, scanner.Err()
+}
+
+func main() {
+	flag.Usage = func() {
+		fmt.Fprintln(os.Stderr, "usage: moeparse [flags] [file ...]")
+		flag.PrintDefaults()
+	}
+	flag.Parse()
+
+	formatter, ok := formatters[*format]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "moeparse: unknown format %q\n", *format)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	newlineMode, ok := newlineModes[*newlines]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "moeparse: unknown newline mode %q\n", *newlines)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	misnestMode, ok := misnestModes[*misnesting]
+	if !ok {
+		fmt.Fprintf(os.Stderr, "moeparse: unknown misnesting mode %q\n", *misnesting)
+		flag.Usage()
+		os.Exit(2)
+	}
+
+	var perms *permission.Set
+	switch {
+	case *allow != "" && *deny != "":
+		fmt.Fprintln(os.Stderr, "moeparse: -allow and -deny can't be used together")
+		flag.Usage()
+		os.Exit(2)
+	case *allow != "":
+		perms = permission.Allow(strings.Split(*allow, ",")...)
+	case *deny != "":
+		perms = permission.Deny(strings.Split(*deny, ",")...)
+	}
+	if perms != nil && *strip {
+		perms.Denied = permission.Strip
+	}
+
+	parser := bbcode.NewParser(bbcode.DefaultTags())
+	if *rulesetFile != "" {
+		rs, err := ruleset.LoadFile(*rulesetFile)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, err)
+			os.Exit(2)
+		}
+		parser = rs.Parser()
+	}
+	if *check {
+		parser.CheckOutput = htmlcheck.Check
+	}
+	if *highlightOn {
+		parser.Highlight = highlight.HTML
+	}
+	parser.Newlines = newlineMode
+	parser.Misnesting = misnestMode
+	parser.Preview = *preview
+
+	var messages []message
+	if flag.NArg() == 0 {
+		msgs, err := readMessages("<stdin>", os.Stdin)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "moeparse:", err)
+			os.Exit(1)
+		}
+		messages = msgs
+	}
+	for _, name := range flag.Args() {
+		f, err := os.Open(name)
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "moeparse:", err)
+			os.Exit(1)
+		}
+		msgs, err := readMessages(name, f)
+		f.Close()
+		if err != nil {
+			fmt.Fprintln(os.Stderr, "moeparse:", err)
+			os.Exit(1)
+		}
+		messages = append(messages, msgs...)
+	}
+
+	out := bufio.NewWriter(os.Stdout)
+
+	status := 0
+	for _, msg := range messages {
+		body := msg.body
+		if !*lines {
+			body = strings.TrimSuffix(body, "\n")
+		}
+
+		doc, err := parser.ParseDocumentWith(body, perms)
+		if err == nil && *strict {
+			err = doc.Err()
+		}
+		if err != nil {
+			out.Flush()
+			for _, line := range strings.Split(err.Error(), "\n") {
+				fmt.Fprintf(os.Stderr, "%s: %s\n", msg.source, line)
+			}
+			status = 1
+			continue
+		}
+
+		if pending := doc.Pending(); len(pending) != 0 {
+			names := make([]string, len(pending))
+			for i, n := range pending {
+				names[i] = "[" + n.Name + "]"
+			}
+			out.Flush()
+			fmt.Fprintf(os.Stderr, "%s: would close %s\n", msg.source, strings.Join(names, ", "))
+		}
+
+		if err := formatter(parser, doc, out); err != nil {
+			out.Flush()
+			fmt.Fprintf(os.Stderr, "%s: %s\n", msg.source, err)
+			status = 1
+		}
+	}
+
+	out.Flush()
+	os.Exit(status)
+}
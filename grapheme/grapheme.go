@@ -0,0 +1,132 @@
+/*
+ * Package grapheme splits text into grapheme clusters, the characters a reader sees:
+ * a letter and its accents, an emoji with its skin tone or the emoji joined to it,
+ * a flag, or a Hangul syllable made of jamo.
+ *
+ * It implements the rules of Unicode's UAX #29 that matter for chat, using the tables
+ * in the unicode package. Emoji are approximated as symbols (So) and the code points
+ * from U+1F000 to U+1FAFF, and prepended concatenation marks aren't handled.
+ */
+package grapheme
+
+import (
+	"unicode"
+	"unicode/utf8"
+)
+
+const zwj = '\u200d'
+
+// isControl returns whether r is always a cluster of its own.
+func isControl(r rune) bool {
+	return unicode.Is(unicode.Cc, r) || r == '\u2028' || r == '\u2029'
+}
+
+// isExtend returns whether r extends the cluster before it.
+func isExtend(r rune) bool {
+	return unicode.In(r, unicode.Mn, unicode.Me, unicode.Mc) ||
+		r == zwj || r == '\u200c' ||
+		r >= 0x1f3fb && r <= 0x1f3ff || // Skin tone modifiers
+		r >= 0xe0020 && r <= 0xe007f // Tags, used by subdivision flags
+}
+
+func isPictographic(r rune) bool {
+	return unicode.Is(unicode.So, r) || r >= 0x1f000 && r <= 0x1faff
+}
+
+func isRegional(r rune) bool {
+	return r >= 0x1f1e6 && r <= 0x1f1ff
+}
+
+// The kinds of Hangul jamo and syllables
+const (
+	notHangul = iota
+	hangulL
+	hangulV
+	hangulT
+	hangulLV
+	hangulLVT
+)
+
+func hangul(r rune) int {
+	switch {
+	case r >= 0x1100 && r <= 0x115f, r >= 0xa960 && r <= 0xa97c:
+		return hangulL
+	case r >= 0x1160 && r <= 0x11a7, r >= 0xd7b0 && r <= 0xd7c6:
+		return hangulV
+	case r >= 0x11a8 && r <= 0x11ff, r >= 0xd7cb && r <= 0xd7fb:
+		return hangulT
+	case r >= 0xac00 && r <= 0xd7a3:
+		if (r-0xac00)%28 == 0 {
+			return hangulLV
+		}
+		return hangulLVT
+	}
+	return notHangul
+}
+
+// joinsHangul returns whether the Hangul kinds prev and next are part of the same syllable.
+func joinsHangul(prev, next int) bool {
+	switch prev {
+	case hangulL:
+		return next == hangulL || next == hangulV || next == hangulLV || next == hangulLVT
+	case hangulV, hangulLV:
+		return next == hangulV || next == hangulT
+	case hangulT, hangulLVT:
+		return next == hangulT
+	}
+	return false
+}
+
+// Next returns the length in bytes of the grapheme cluster at the start of s.
+func Next(s string) int {
+	r, i := utf8.DecodeRuneInString(s)
+	if i == 0 {
+		return 0
+	}
+	if r == '\r' && len(s) > 1 && s[1] == '\n' {
+		return 2
+	}
+	if isControl(r) {
+		return i
+	}
+
+	prev := r
+	pictographic := isPictographic(r)
+	regionalPair := isRegional(r) // Whether r is a regional indicator still waiting for the other half of its flag
+	for i < len(s) {
+		next, size := utf8.DecodeRuneInString(s[i:])
+		switch {
+		case isControl(next):
+			return i
+		case isExtend(next):
+		case prev == zwj && pictographic && isPictographic(next):
+		case regionalPair && isRegional(next):
+			regionalPair = false
+		case joinsHangul(hangul(prev), hangul(next)):
+		default:
+			return i
+		}
+		prev = next
+		i += size
+	}
+	return i
+}
+
+// Count returns the number of grapheme clusters in s.
+func Count(s string) int {
+	n := 0
+	for i := 0; i < len(s); i += Next(s[i:]) {
+		n++
+	}
+	return n
+}
+
+// Index returns the offset in bytes of the n'th grapheme cluster of s, counting from 0,
+// or len(s) if s has n clusters or fewer. s[:Index(s, n)] is the first n clusters of s.
+func Index(s string, n int) int {
+	i := 0
+	for ; n > 0 && i < len(s); n-- {
+		i += Next(s[i:])
+	}
+	return i
+}
@@ -0,0 +1,37 @@
+package grapheme_test
+
+import (
+	"."
+	"testing"
+)
+
+func TestCount(t *testing.T) {
+	tests := map[string]int{
+		"":                0,
+		"hello":           5,
+		"e\u0301te\u0301": 3, // Combining accents
+		"\r\n\n":          2,
+		"👍🏽":              1, // Skin tone
+		"👩\u200d💻 ok":     4, // Joined emoji
+		"❤\ufe0f":         1, // Variation selector
+		"🇯🇵🇫🇷🇩":           3, // Two flags and half of one
+		"🏴\U000e0067\U000e0062\U000e0065\U000e006e\U000e0067\U000e007f": 1,
+		"\u1100\u1161\u11a8": 1, // Jamo making one syllable
+		"한국어":                3,
+		"a\u200db":           2,
+		"\xff\xfe":           2,
+	}
+	for s, expected := range tests {
+		if n := grapheme.Count(s); n != expected {
+			t.Errorf("%q has %d clusters, expected %d", s, n, expected)
+		}
+	}
+
+	s := "a👩\u200d💻b"
+	if i := grapheme.Index(s, 2); s[:i] != "a👩\u200d💻" {
+		t.Errorf("The first two clusters of %q are %q", s, s[:i])
+	}
+	if i := grapheme.Index(s, 5); i != len(s) {
+		t.Errorf("Index past the end of %q is %d", s, i)
+	}
+}
@@ -0,0 +1,229 @@
+/*
+ * Package highlight is a small syntax highlighter for code blocks.
+ *
+ * It only knows about keywords, strings, comments and numbers, which is enough to make
+ * code in chat readable without pulling in a full lexer for every language. The output
+ * is the escaped code with those parts wrapped in spans with the classes hl-keyword,
+ * hl-string, hl-comment and hl-number; removing the spans gives exactly
+ * html.EscapeString(code).
+ */
+package highlight
+
+import (
+	"bytes"
+	"html"
+	"strings"
+)
+
+// A Language describes how to highlight code in one language.
+type Language struct {
+	Keywords      map[string]bool
+	LineComments  []string    // Prefixes that start a comment running to the end of the line, i.e. //
+	BlockComments [][2]string // The start and end of comments that can span lines, i.e. /* and */
+	Quotes        string      // Characters that start and end strings, in which \ escapes the next character
+	RawQuotes     string      // Characters that start and end strings with no escapes, which can span lines
+}
+
+func keywords(list string) map[string]bool {
+	ret := make(map[string]bool)
+	for _, kw := range strings.Fields(list) {
+		ret[kw] = true
+	}
+	return ret
+}
+
+var (
+	goLang = &Language{
+		Keywords: keywords(`break case chan const continue default defer else fallthrough for func go goto
+			if import interface map package range return select struct switch type var nil true false iota`),
+		LineComments:  []string{"//"},
+		BlockComments: [][2]string{{"/*", "*/"}},
+		Quotes:        `"'`,
+		RawQuotes:     "`",
+	}
+	cLang = &Language{
+		Keywords: keywords(`auto break case char const continue default do double else enum extern float for
+			goto if inline int long register return short signed sizeof static struct switch typedef union
+			unsigned void volatile while bool true false NULL nullptr class namespace template typename public
+			private protected virtual new delete this using`),
+		LineComments:  []string{"//"},
+		BlockComments: [][2]string{{"/*", "*/"}},
+		Quotes:        `"'`,
+	}
+	jsLang = &Language{
+		Keywords: keywords(`async await break case catch class const continue debugger default delete do else
+			export extends finally for function if import in instanceof let new return super switch this throw
+			try typeof var void while yield null undefined true false of interface type enum`),
+		LineComments:  []string{"//"},
+		BlockComments: [][2]string{{"/*", "*/"}},
+		Quotes:        `"'`,
+		RawQuotes:     "`",
+	}
+	pythonLang = &Language{
+		Keywords: keywords(`and as assert async await break class continue def del elif else except finally
+			for from global if import in is lambda nonlocal not or pass raise return try while with yield
+			None True False`),
+		LineComments: []string{"#"},
+		Quotes:       `"'`,
+	}
+	rustLang = &Language{
+		Keywords: keywords(`as async await break const continue crate dyn else enum extern false fn for if impl
+			in let loop match mod move mut pub ref return self Self static struct super trait true type unsafe
+			use where while`),
+		LineComments:  []string{"//"},
+		BlockComments: [][2]string{{"/*", "*/"}},
+		Quotes:        `"`,
+	}
+	shellLang = &Language{
+		Keywords:     keywords(`if then else elif fi for while until do done case esac in function return local export`),
+		LineComments: []string{"#"},
+		Quotes:       `"`,
+		RawQuotes:    `'`,
+	}
+	jsonLang = &Language{
+		Keywords: keywords(`true false null`),
+		Quotes:   `"`,
+	}
+)
+
+// Languages maps the language names used in code blocks to their Languages.
+// Languages can be added before any code is highlighted.
+var Languages = map[string]*Language{
+	"go":         goLang,
+	"golang":     goLang,
+	"c":          cLang,
+	"cpp":        cLang,
+	"c++":        cLang,
+	"js":         jsLang,
+	"javascript": jsLang,
+	"ts":         jsLang,
+	"typescript": jsLang,
+	"py":         pythonLang,
+	"python":     pythonLang,
+	"rs":         rustLang,
+	"rust":       rustLang,
+	"sh":         shellLang,
+	"bash":       shellLang,
+	"json":       jsonLang,
+}
+
+// HTML highlights code written in lang. If lang isn't in Languages, it returns false.
+// Its signature matches bbcode.Parser.Highlight.
+func HTML(lang, code string) (string, bool) {
+	l, ok := Languages[strings.ToLower(lang)]
+	if !ok {
+		return "", false
+	}
+	return l.HTML(code), true
+}
+
+func isIdentStart(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c == '_'
+}
+
+func isIdent(c byte) bool {
+	return isIdentStart(c) || c >= '0' && c <= '9'
+}
+
+// HTML highlights code.
+func (l *Language) HTML(code string) string {
+	buf := &bytes.Buffer{}
+	plain := 0 // The start of the text that hasn't been written yet
+	span := func(start, end int, class string) {
+		buf.WriteString(html.EscapeString(code[plain:start]))
+		buf.WriteString(`<span class="hl-` + class + `">`)
+		buf.WriteString(html.EscapeString(code[start:end]))
+		buf.WriteString("</span>")
+		plain = end
+	}
+
+	for i := 0; i < len(code); {
+		rest := code[i:]
+		c := code[i]
+
+		if prefix := l.lineComment(rest); prefix != "" {
+			end := strings.IndexByte(rest, '\n')
+			if end < 0 {
+				end = len(rest)
+			}
+			span(i, i+end, "comment")
+			i += end
+			continue
+		}
+		if delims := l.blockComment(rest); delims != nil {
+			end := strings.Index(rest[len(delims[0]):], delims[1])
+			if end < 0 {
+				end = len(rest)
+			} else {
+				end += len(delims[0]) + len(delims[1])
+			}
+			span(i, i+end, "comment")
+			i += end
+			continue
+		}
+
+		switch {
+		case strings.IndexByte(l.RawQuotes, c) >= 0:
+			end := strings.IndexByte(rest[1:], c)
+			if end < 0 {
+				end = len(rest)
+			} else {
+				end += 2
+			}
+			span(i, i+end, "string")
+			i += end
+		case strings.IndexByte(l.Quotes, c) >= 0:
+			end := 1
+			for end < len(rest) && rest[end] != c && rest[end] != '\n' {
+				if rest[end] == '\\' && end+1 < len(rest) && rest[end+1] != '\n' {
+					end++
+				}
+				end++
+			}
+			if end < len(rest) && rest[end] == c {
+				end++
+			}
+			span(i, i+end, "string")
+			i += end
+		case c >= '0' && c <= '9' && (i == 0 || !isIdent(code[i-1])):
+			end := 1
+			for end < len(rest) && (isIdent(rest[end]) || rest[end] == '.') {
+				end++
+			}
+			span(i, i+end, "number")
+			i += end
+		case isIdentStart(c) && (i == 0 || !isIdent(code[i-1])):
+			end := 1
+			for end < len(rest) && isIdent(rest[end]) {
+				end++
+			}
+			if l.Keywords[rest[:end]] {
+				span(i, i+end, "keyword")
+			}
+			i += end
+		default:
+			i++
+		}
+	}
+
+	buf.WriteString(html.EscapeString(code[plain:]))
+	return buf.String()
+}
+
+func (l *Language) lineComment(s string) string {
+	for _, prefix := range l.LineComments {
+		if strings.HasPrefix(s, prefix) {
+			return prefix
+		}
+	}
+	return ""
+}
+
+func (l *Language) blockComment(s string) *[2]string {
+	for i, delims := range l.BlockComments {
+		if strings.HasPrefix(s, delims[0]) {
+			return &l.BlockComments[i]
+		}
+	}
+	return nil
+}
@@ -0,0 +1,40 @@
+package highlight_test
+
+import (
+	"."
+	"html"
+	"regexp"
+	"testing"
+)
+
+var spanRe = regexp.MustCompile(`</?span[^>]*>`)
+
+func TestHTML(t *testing.T) {
+	out, ok := highlight.HTML("go", `if x := "a<b"; x != nil { // done`+"\n}")
+	expected := `<span class="hl-keyword">if</span> x := <span class="hl-string">&#34;a&lt;b&#34;</span>; x != ` +
+		`<span class="hl-keyword">nil</span> { <span class="hl-comment">// done</span>` + "\n}"
+	if !ok || out != expected {
+		t.Errorf("Go highlighted as %q", out)
+	}
+
+	if _, ok := highlight.HTML("brainfuck", "+[-]"); ok {
+		t.Error("Highlighted an unknown language")
+	}
+
+	// Highlighting must never change the text, only add spans
+	inputs := []string{
+		"x = 'unterminated\nprint(\"a\\\"b\", 0x1F) # <c>",
+		"/* never closed <b>&amp;",
+		"`raw\nstring` + 'a' + \"\\",
+		"fn main() { let x = 1.5e3; } // ünïcödé",
+		"echo 'it''s' \"$HOME\" && done",
+	}
+	for lang := range highlight.Languages {
+		for _, input := range inputs {
+			out, _ := highlight.HTML(lang, input)
+			if text := spanRe.ReplaceAllString(out, ""); text != html.EscapeString(input) {
+				t.Errorf("%s: %q highlighted as %q", lang, input, out)
+			}
+		}
+	}
+}
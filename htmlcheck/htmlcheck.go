@@ -0,0 +1,339 @@
+/*
+ * Package htmlcheck checks that HTML produced by the parser is well-formed and safe.
+ *
+ * It only understands the small subset of HTML that the parser outputs: elements
+ * with double-quoted attributes, escaped text and character references. Anything
+ * else, such as comments or unquoted attributes, is reported as an error. This
+ * makes it suitable as a last line of defence in Parse and as an oracle in fuzz tests.
+ */
+package htmlcheck
+
+import (
+	"fmt"
+	"html"
+	"strings"
+)
+
+// A Policy describes the HTML that is allowed.
+type Policy struct {
+	// The allowed elements, mapped to the attributes they may have
+	Elements map[string][]string
+	// Elements that never have a closing tag, i.e. img
+	Void map[string]bool
+	// Block elements, which may not be put inside inline elements. Every allowed element that isn't a block element is inline.
+	Block map[string]bool
+	// Block elements that may only hold inline elements, i.e. h1 and p
+	PhrasingOnly map[string]bool
+	// Elements that may only be the direct children of one of the given elements, i.e. li in ul or ol
+	Parents map[string][]string
+	// Whether to check that block elements aren't nested in inline or PhrasingOnly elements
+	CheckNesting bool
+}
+
+// An Error is a problem found in HTML.
+type Error struct {
+	Offset int // The byte offset of the problem
+	Msg    string
+}
+
+func (e *Error) Error() string {
+	return fmt.Sprintf("htmlcheck: offset %d: %s", e.Offset, e.Msg)
+}
+
+// urlAttributes are checked for URL schemes that can run code.
+var urlAttributes = map[string]bool{"href": true, "src": true, "cite": true, "action": true, "poster": true}
+
+// badSchemes are URL schemes, other than javascript:, that can run code.
+var badSchemes = []string{"vbscript:", "data:"}
+
+// DefaultPolicy returns a Policy that allows the HTML output by the built-in BBCode tags.
+func DefaultPolicy() *Policy {
+	return &Policy{
+		Elements: map[string][]string{
+			"b":          {"class"},
+			"i":          {"class"},
+			"s":          {"class"},
+			"q":          {"class"},
+			"samp":       {"class"},
+			"span":       {"class", "style", "role", "tabindex", "aria-expanded"},
+			"pre":        {"class"},
+			"code":       {"class"},
+			"a":          {"class", "href", "title"},
+			"img":        {"class", "src", "title", "alt"},
+			"ul":         {"class"},
+			"ol":         {"class", "type"},
+			"li":         {"class"},
+			"table":      {"class"},
+			"tr":         {"class"},
+			"td":         {"class"},
+			"th":         {"class"},
+			"blockquote": {"class"},
+			"cite":       {"class"},
+			"details":    {"class"},
+			"summary":    {"class"},
+			"p":          {"class"},
+			"h1":         {"class"},
+			"h2":         {"class"},
+			"h3":         {"class"},
+			"div":        {"class"},
+			"hr":         {"class"},
+			"iframe":     {"class", "src", "sandbox", "allow", "loading"},
+			"video":      {"class", "src", "controls", "preload"},
+			"audio":      {"class", "src", "controls", "preload"},
+			"br":         {},
+		},
+		Void: map[string]bool{"img": true, "br": true, "hr": true},
+		Block: map[string]bool{"pre": true, "ul": true, "ol": true, "li": true,
+			"table": true, "tr": true, "td": true, "th": true, "blockquote": true,
+			"details": true, "p": true, "h1": true, "h2": true, "h3": true, "div": true, "hr": true},
+		PhrasingOnly: map[string]bool{"p": true, "h1": true, "h2": true, "h3": true, "h4": true, "h5": true, "h6": true},
+		Parents: map[string][]string{
+			"li":      {"ul", "ol"},
+			"tr":      {"table"},
+			"td":      {"tr"},
+			"th":      {"tr"},
+			"summary": {"details"},
+		},
+		CheckNesting: true,
+	}
+}
+
+// Check checks html against the default policy.
+func Check(html string) error {
+	return DefaultPolicy().Check(html)
+}
+
+// Check returns an *Error describing the first problem in html, or nil if there are none.
+func (p *Policy) Check(html string) error {
+	c := &checker{policy: p, html: html}
+	return c.check()
+}
+
+type openElement struct {
+	name   string
+	offset int
+}
+
+type checker struct {
+	policy *Policy
+	html   string
+	pos    int
+	stack  []openElement
+}
+
+func (c *checker) errorf(offset int, format string, args ...interface{}) error {
+	return &Error{offset, fmt.Sprintf(format, args...)}
+}
+
+func (c *checker) check() error {
+	for c.pos < len(c.html) {
+		var err error
+		switch c.html[c.pos] {
+		case '<':
+			err = c.tag()
+		case '&':
+			err = c.reference()
+		case '>':
+			err = c.errorf(c.pos, "unescaped >")
+		default:
+			c.pos++
+		}
+		if err != nil {
+			return err
+		}
+	}
+
+	if len(c.stack) != 0 {
+		top := c.stack[len(c.stack)-1]
+		return c.errorf(top.offset, "<%s> is never closed", top.name)
+	}
+	return nil
+}
+
+// reference checks a character reference, i.e. &amp; or &#34;
+func (c *checker) reference() error {
+	end := strings.IndexByte(c.html[c.pos:], ';')
+	if end < 2 || end > 10 {
+		return c.errorf(c.pos, "unescaped &")
+	}
+	ref := c.html[c.pos : c.pos+end+1]
+	if html.UnescapeString(ref) == ref {
+		return c.errorf(c.pos, "invalid character reference %s", ref)
+	}
+	c.pos += end + 1
+	return nil
+}
+
+func isNameChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= '0' && c <= '9' || c == '-'
+}
+
+func (c *checker) name() string {
+	start := c.pos
+	for c.pos < len(c.html) && isNameChar(c.html[c.pos]) {
+		c.pos++
+	}
+	return c.html[start:c.pos]
+}
+
+func (c *checker) tag() error {
+	start := c.pos
+	c.pos++
+	closing := c.pos < len(c.html) && c.html[c.pos] == '/'
+	if closing {
+		c.pos++
+	}
+
+	name := c.name()
+	if name == "" {
+		return c.errorf(start, "unescaped <")
+	}
+	attrs, ok := c.policy.Elements[name]
+	if !ok {
+		return c.errorf(start, "<%s> is not allowed", name)
+	}
+
+	if closing {
+		if c.pos >= len(c.html) || c.html[c.pos] != '>' {
+			return c.errorf(start, "malformed closing tag </%s", name)
+		}
+		c.pos++
+		if c.policy.Void[name] {
+			return c.errorf(start, "<%s> can't have a closing tag", name)
+		}
+		if len(c.stack) == 0 {
+			return c.errorf(start, "</%s> doesn't close any element", name)
+		}
+		if top := c.stack[len(c.stack)-1]; top.name != name {
+			return c.errorf(start, "</%s> closes <%s>", name, top.name)
+		}
+		c.stack = c.stack[:len(c.stack)-1]
+		return nil
+	}
+
+	if err := c.attributes(name, attrs); err != nil {
+		return err
+	}
+	if err := c.nesting(start, name); err != nil {
+		return err
+	}
+	if !c.policy.Void[name] {
+		c.stack = append(c.stack, openElement{name, start})
+	}
+	return nil
+}
+
+// attributes checks the attributes of a start tag up to and including its closing >.
+func (c *checker) attributes(element string, allowed []string) error {
+	seen := make(map[string]bool)
+	for {
+		if c.pos >= len(c.html) {
+			return c.errorf(c.pos, "unterminated <%s>", element)
+		}
+		if c.html[c.pos] == '>' {
+			c.pos++
+			return nil
+		}
+		if c.html[c.pos] != ' ' {
+			return c.errorf(c.pos, "expected a space before an attribute of <%s>", element)
+		}
+		c.pos++
+
+		attrStart := c.pos
+		attr := c.name()
+		if attr == "" {
+			return c.errorf(attrStart, "malformed attribute in <%s>", element)
+		}
+		if !contains(allowed, attr) {
+			return c.errorf(attrStart, "<%s> may not have a %s attribute", element, attr)
+		}
+		if seen[attr] {
+			return c.errorf(attrStart, "duplicate %s attribute", attr)
+		}
+		seen[attr] = true
+
+		if !strings.HasPrefix(c.html[c.pos:], "=\"") {
+			return c.errorf(c.pos, "the %s attribute must have a double-quoted value", attr)
+		}
+		c.pos += 2
+		end := strings.IndexAny(c.html[c.pos:], "\"<>")
+		if end < 0 || c.html[c.pos+end] != '"' {
+			return c.errorf(attrStart, "malformed value for the %s attribute", attr)
+		}
+		value := html.UnescapeString(c.html[c.pos : c.pos+end])
+		c.pos += end + 1
+
+		if err := c.value(attrStart, attr, value); err != nil {
+			return err
+		}
+	}
+}
+
+// value checks that an attribute's value can't run code.
+func (c *checker) value(offset int, attr, value string) error {
+	// Browsers ignore whitespace and control characters in schemes, i.e. "java\tscript:"
+	normalized := strings.Map(func(r rune) rune {
+		if r <= ' ' || r == 0x7f {
+			return -1
+		}
+		return r
+	}, strings.ToLower(value))
+
+	if strings.HasPrefix(attr, "on") {
+		return c.errorf(offset, "event handler attribute %s", attr)
+	}
+	if attr == "style" {
+		for _, bad := range []string{"url(", "expression(", "@import", "\\"} {
+			if strings.Contains(normalized, bad) {
+				return c.errorf(offset, "style contains %s", bad)
+			}
+		}
+	}
+	if urlAttributes[attr] {
+		if strings.Contains(normalized, "javascript:") {
+			return c.errorf(offset, "the %s attribute contains javascript:", attr)
+		}
+		for _, scheme := range badSchemes {
+			if strings.HasPrefix(normalized, scheme) {
+				return c.errorf(offset, "the %s attribute has a %s URL", attr, scheme)
+			}
+		}
+	}
+	return nil
+}
+
+// nesting checks that name may be put inside the currently open elements.
+func (c *checker) nesting(offset int, name string) error {
+	parent := ""
+	if len(c.stack) != 0 {
+		parent = c.stack[len(c.stack)-1].name
+	}
+	if parents, ok := c.policy.Parents[name]; ok && !contains(parents, parent) {
+		return c.errorf(offset, "<%s> must be inside one of %v", name, parents)
+	}
+
+	if !c.policy.CheckNesting {
+		return nil
+	}
+	for _, open := range c.stack {
+		if open.name == name && name == "a" {
+			return c.errorf(offset, "<a> inside <a>")
+		}
+		if c.policy.Block[name] && !c.policy.Block[open.name] {
+			return c.errorf(offset, "block element <%s> inside inline element <%s>", name, open.name)
+		}
+		if c.policy.Block[name] && c.policy.PhrasingOnly[open.name] {
+			return c.errorf(offset, "block element <%s> inside <%s>, which may only hold inline elements", name, open.name)
+		}
+	}
+	return nil
+}
+
+func contains(list []string, s string) bool {
+	for _, l := range list {
+		if l == s {
+			return true
+		}
+	}
+	return false
+}
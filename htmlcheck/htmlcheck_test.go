@@ -0,0 +1,97 @@
+package htmlcheck_test
+
+import (
+	"."
+	"github.com/moechat/parser/bbcode"
+	"strings"
+	"testing"
+)
+
+func TestCheck(t *testing.T) {
+	tests := []struct {
+		html string
+		err  string // A substring of the expected error, or "" if the HTML is fine
+	}{
+		{`<b>hi &amp; <i class="x">there</i></b><img src="a.png">`, ""},
+		{`<a href="http://a?b=1&amp;c=2">x</a>`, ""},
+		{`<span style="color: red;">x</span>`, ""},
+		{`<b><i>x</b></i>`, "</b> closes <i>"},
+		{`<b>x`, "<b> is never closed"},
+		{`x</b>`, "</b> doesn't close any element"},
+		{`<script>x</script>`, "<script> is not allowed"},
+		{`<b onclick="x">x</b>`, "may not have a onclick attribute"},
+		{`<a href="java&#9;script:alert(1)">x</a>`, "contains javascript:"},
+		{`<img src="javascript:x">`, "contains javascript:"},
+		{`<img title="javascript:x">`, ""}, // Only URLs can run code
+		{`<img src="data:text/html,x">`, "has a data: URL"},
+		{`<span style="background: url(x)">x</span>`, "style contains url("},
+		{`<a href=x>x</a>`, "double-quoted value"},
+		{`a < b`, "unescaped <"},
+		{`a & b`, "unescaped &"},
+		{`<b><pre>x</pre></b>`, "block element <pre> inside inline element <b>"},
+		{`<a href="x"><a href="y">x</a></a>`, "<a> inside <a>"},
+		{`<h1><h2>x</h2></h1>`, "block element <h2> inside <h1>"},
+		{`<h1><div>x</div></h1>`, "block element <div> inside <h1>"},
+		{`<p>x <b>y</b></p><div><h1>z</h1></div>`, ""},
+		{`<img src="x"></img>`, "can't have a closing tag"},
+	}
+
+	for _, test := range tests {
+		err := htmlcheck.Check(test.html)
+		switch {
+		case err == nil && test.err != "":
+			t.Errorf("%s: expected an error containing %q", test.html, test.err)
+		case err != nil && test.err == "":
+			t.Errorf("%s: unexpected error %s", test.html, err)
+		case err != nil && !strings.Contains(err.Error(), test.err):
+			t.Errorf("%s: expected an error containing %q, got %s", test.html, test.err, err)
+		}
+	}
+
+	p := bbcode.NewParser(bbcode.DefaultTags())
+	p.CheckOutput = htmlcheck.Check
+	for _, input := range []string{"[b][code]x[/code][/b]", "[h1][h2]x[/h2][/h1]", "[h1]x[center]y[/center][/h1]"} {
+		if _, err := p.Parse(input); err != nil {
+			t.Errorf("Block tags inside inline ones weren't fixed in %q: %s", input, err)
+		}
+	}
+	policy := htmlcheck.DefaultPolicy()
+	delete(policy.Elements, "b")
+	p.CheckOutput = policy.Check
+	if _, err := p.Parse("[b]x[/b]"); err == nil {
+		t.Error("Parse didn't run CheckOutput")
+	}
+}
+
+// FuzzParse checks that bbcode.Parse always produces balanced, safe HTML.
+func FuzzParse(f *testing.F) {
+	for _, seed := range []string{
+		"[b][i]x[/b][/i]",
+		"[url=http://a]x[/url] [url]http://b[/url]",
+		"[img]http://a/b.png[/img][img=x]",
+		"[color=red]x[/colour] [size=12px]y",
+		"[code][b]x[/code][/b] <script>&amp;",
+		"[list=1][*]a[list][*]b[/list]stray[*]c[/list][*]d",
+		"[table]x[tr][th]a[td]b[/tr][td]c[/table][tr]",
+		`[quote name="a" msg=1][quote=b]x[/quote][/quote]`,
+		"||a [spoiler=t]b|| c[/spoiler]",
+		"[b]x[center]y[list][*]z[/list][/center][hr][/b]",
+		"[url=http://a][h1]x[code]y[/code][/h1][/url]",
+		"[youtube]https://youtu.be/dQw4w9WgXcQ?t=5[/youtube][video=x\"][audio]https://a/b[/audio]",
+		"[img]javascript:alert(1)[/img]",
+		"[url ][url ][/url]",
+		"[h1][h2]x[/h2][center]y[quote]z[/quote][/center][/h1]",
+	} {
+		f.Add(seed)
+	}
+
+	f.Fuzz(func(t *testing.T, input string) {
+		out, err := bbcode.Parse(input)
+		if err != nil {
+			t.Skip()
+		}
+		if err := htmlcheck.Check(out); err != nil {
+			t.Errorf("%q rendered as %q: %s", input, out, err)
+		}
+	})
+}
@@ -0,0 +1,77 @@
+/*
+ * Package imageproxy rewrites image URLs so they are loaded through a camo-style proxy.
+ * The proxy fetches images for users, so the sites they are on never see the users'
+ * IPs, and serves them over HTTPS, so they don't break mixed content rules.
+ *
+ * A proxied URL is Base/<digest>/<hex url>, where digest is the hex HMAC-SHA1 of the
+ * URL under a key shared with the proxy. The proxy only fetches URLs with a valid
+ * digest, so it can't be used to fetch anything else. This is the format used by
+ * camo and go-camo.
+ */
+package imageproxy
+
+import (
+	"context"
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/hex"
+	"net/url"
+	"strings"
+)
+
+// A Proxy rewrites URLs for a single image proxy.
+type Proxy struct {
+	base string
+	key  []byte
+}
+
+// New returns a Proxy for the image proxy at base, i.e. https://camo.example.com, which uses key.
+func New(base string, key []byte) *Proxy {
+	return &Proxy{base: strings.TrimSuffix(base, "/"), key: key}
+}
+
+func (p *Proxy) digest(link string) string {
+	mac := hmac.New(sha1.New, p.key)
+	mac.Write([]byte(link))
+	return hex.EncodeToString(mac.Sum(nil))
+}
+
+// Rewrite returns the URL of link through the proxy. Only links to other sites are proxied:
+// relative URLs, URLs that aren't http or https, and URLs that are already proxied are
+// returned as they are. Links starting with // are proxied as https.
+func (p *Proxy) Rewrite(link string) string {
+	u, err := url.Parse(link)
+	if err != nil || u.Host == "" || strings.HasPrefix(link, p.base+"/") {
+		return link
+	}
+	switch strings.ToLower(u.Scheme) {
+	case "":
+		link = "https:" + link
+	case "http", "https":
+	default:
+		return link
+	}
+	return p.base + "/" + p.digest(link) + "/" + hex.EncodeToString([]byte(link))
+}
+
+// RewriteImage is Rewrite with the signature of bbcode.Parser.RewriteImage, so p can be used there directly.
+func (p *Proxy) RewriteImage(ctx context.Context, link string) string {
+	return p.Rewrite(link)
+}
+
+// URL returns the link that proxied, a URL returned by Rewrite, loads, or false if
+// proxied isn't a URL for p or its digest doesn't match. This is what the proxy checks.
+func (p *Proxy) URL(proxied string) (string, bool) {
+	if !strings.HasPrefix(proxied, p.base+"/") {
+		return "", false
+	}
+	parts := strings.Split(proxied[len(p.base)+1:], "/")
+	if len(parts) != 2 {
+		return "", false
+	}
+	link, err := hex.DecodeString(parts[1])
+	if err != nil || !hmac.Equal([]byte(parts[0]), []byte(p.digest(string(link)))) {
+		return "", false
+	}
+	return string(link), true
+}
@@ -0,0 +1,45 @@
+package imageproxy_test
+
+import (
+	"."
+	"context"
+	"testing"
+)
+
+func TestRewrite(t *testing.T) {
+	p := imageproxy.New("https://camo.example.com/", []byte("0x24FEEDFACEDEADBEEFCAFE"))
+
+	// The digest is the HMAC-SHA1 of the URL
+	link := "http://images.example.com/a.png"
+	expected := "https://camo.example.com/a7eac0630ecfe9886c3926867f13fb5cfdd4c42f/687474703a2f2f696d616765732e6578616d706c652e636f6d2f612e706e67"
+	if out := p.Rewrite(link); out != expected {
+		t.Errorf("%q was rewritten to %q, expected %q", link, out, expected)
+	}
+	if out := p.RewriteImage(context.Background(), link); out != expected {
+		t.Errorf("RewriteImage rewrote %q to %q, expected %q", link, out, expected)
+	}
+
+	for _, same := range []string{"/uploads/a.png", "a.png", "data:image/png;base64,AAAA", "javascript:alert(1)", expected, "%zz"} {
+		if out := p.Rewrite(same); out != same {
+			t.Errorf("%q was rewritten to %q", same, out)
+		}
+	}
+
+	for _, link := range []string{"https://x.test/a b.png?c=d#e", "//x.test/a.png"} {
+		out, ok := p.URL(p.Rewrite(link))
+		if link[0] == '/' {
+			link = "https:" + link
+		}
+		if !ok || out != link {
+			t.Errorf("%q was proxied as %q, %t", link, out, ok)
+		}
+	}
+
+	proxied := p.Rewrite(link)
+	other := imageproxy.New("https://camo.example.com", []byte("other key"))
+	for _, bad := range []string{proxied[:len(proxied)-2], proxied + "/x", "https://other.example.com/a/b", other.Rewrite(link)} {
+		if out, ok := p.URL(bad); ok {
+			t.Errorf("%q was accepted as %q", bad, out)
+		}
+	}
+}
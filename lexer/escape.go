@@ -0,0 +1,53 @@
+package lexer
+
+import (
+	"github.com/moechat/parser/token"
+	"regexp"
+	"strings"
+)
+
+// An escapeMatcher makes the delimiter after an escape character literal.
+type escapeMatcher struct {
+	name string
+	expr Expression
+}
+
+// NewEscapeMatcher returns a Matcher named name that turns esc followed by one of delims, or by
+// another esc, into the text after esc, so the delimiter doesn't start anything. It should be
+// tried before the matchers whose delimiters it escapes.
+func NewEscapeMatcher(name string, esc rune, delims ...string) Matcher {
+	quoted := regexp.QuoteMeta(string(esc))
+	alts := make([]string, 0, len(delims)+1)
+	for _, delim := range delims {
+		alts = append(alts, regexp.QuoteMeta(delim))
+	}
+	alts = append(alts, quoted)
+	return &escapeMatcher{name, Expression{Expr: quoted + "(" + strings.Join(alts, "|") + ")"}}
+}
+
+func (em *escapeMatcher) Name() string {
+	return em.name
+}
+
+func (em *escapeMatcher) Exprs() []Expression {
+	return []Expression{em.expr}
+}
+
+func (em *escapeMatcher) IsValid(args *token.TokenArgs, expNum int) bool {
+	return true
+}
+
+func (em *escapeMatcher) BuildToken(args *token.TokenArgs, expNum int) (token.Token, token.Token) {
+	return token.NewTextToken(args.ById(1)), nil
+}
+
+// Escaped returns whether s ends with an escape character esc that isn't escaped itself, so the
+// delimiter after s is escaped. Nothing is escaped if esc is 0.
+func Escaped(s string, esc rune) bool {
+	n := 0
+	for esc != 0 && strings.HasSuffix(s, string(esc)) {
+		s = s[:len(s)-len(string(esc))]
+		n++
+	}
+	return n%2 == 1
+}
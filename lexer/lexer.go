@@ -1,10 +1,16 @@
 package lexer
 
 import (
+	"context"
 	"errors"
 	"fmt"
+	"github.com/moechat/parser/parsectx"
+	"github.com/moechat/parser/permission"
 	"github.com/moechat/parser/token"
 	"regexp"
+	"regexp/syntax"
+	"strings"
+	"unicode/utf8"
 )
 
 type Flags int
@@ -14,11 +20,17 @@ const (
 	BodyAsArg
 	NoNewline
 	RequireClose
+	// The match must start at the start of the input or right after a newline in it, and not
+	// in the body of another match
+	LineStart
 )
 
 type Expression struct {
 	Expr      string
 	CloseExpr string
+	// If set, what the body between Expr and CloseExpr must match instead of any text. It must be
+	// lazy, like the default .*?, and may not have capture groups (i.e. to skip closing delimiters in quotes)
+	BodyExpr string
 
 	Flags Flags
 }
@@ -32,6 +44,30 @@ type Matcher interface {
 	BuildToken(args *token.TokenArgs, expNum int) (openToken token.Token, closeToken token.Token)
 }
 
+// A ContextMatcher is a Matcher that is given the context of the parse, i.e. to find out who
+// wrote the message using the parsectx package. The Lexer calls its IsValidContext and
+// BuildTokenContext methods instead of IsValid and BuildToken.
+type ContextMatcher interface {
+	Matcher
+	IsValidContext(ctx context.Context, args *token.TokenArgs, expNum int) bool
+	BuildTokenContext(ctx context.Context, args *token.TokenArgs, expNum int) (openToken token.Token, closeToken token.Token)
+}
+
+// An AliasMatcher is a Matcher for the tag named Alias, i.e. md_strike for [s], so the permissions
+// for that tag apply to it too, like they do in a bbcode.Parser. If Alias returns "", only the
+// matcher's own name is checked.
+type AliasMatcher interface {
+	Matcher
+	Alias() string
+}
+
+// A compiledExpr is an Expression after it has been compiled by New.
+type compiledExpr struct {
+	regexp   *regexp.Regexp // Matches a single instance of the expression, used to get its arguments
+	idByName map[string]int // The ids of the named capture groups in regexp
+	subexpr  string         // The subexpression spliced into the Lexer's main regexp
+}
+
 /*
  * This is an implementation of the a Lexer, used to convert text into tokens
  * (http://en.wikipedia.org/wiki/Lexical_analysis) using the regexp package.
@@ -39,15 +75,21 @@ type Matcher interface {
  * Because the regexp package is implemented using a NFA
  * (http://en.wikipedia.org/wiki/Nondeterministic_finite_automaton),
  * it's very effective for this use case.
+ *
+ * A Lexer is never modified after it is created, so it is safe to use from
+ * multiple goroutines. AddMatcher, RemoveMatcher and ReplaceMatcher return a
+ * new Lexer and leave the one they were called on untouched.
  */
 type Lexer struct {
+	names      []string // The names of the matchers, in the order they were added
 	matchers   map[string]Matcher
-	regexps    map[string][]*regexp.Regexp
+	compiled   map[string][]*compiledExpr
 	subexpIds  map[string][]int
 	bodyExpIds map[string][]int
 
 	expr   string         // The main regexp expression
 	regexp *regexp.Regexp // The regexp used to match tags
+	prog   *syntax.Prog   // The compiled form of regexp, used by Relex to see how far it looks ahead
 }
 
 func Must(l *Lexer, err error) *Lexer {
@@ -58,66 +100,165 @@ func Must(l *Lexer, err error) *Lexer {
 }
 
 func New(matchers ...Matcher) (*Lexer, error) {
-	var err error
+	return build(matchers, nil, "")
+}
+
+// AddMatcher returns a new Lexer that uses all of l's matchers and m.
+// It is an error for l to already have a matcher with m's name.
+func (l *Lexer) AddMatcher(m Matcher) (*Lexer, error) {
+	if _, ok := l.matchers[m.Name()]; ok {
+		return nil, errors.New("lexer: a matcher named " + m.Name() + " already exists")
+	}
+	return build(append(l.Matchers(), m), l, "")
+}
+
+// RemoveMatcher returns a new Lexer that uses all of l's matchers except the one named name.
+func (l *Lexer) RemoveMatcher(name string) (*Lexer, error) {
+	if _, ok := l.matchers[name]; !ok {
+		return nil, errors.New("lexer: there is no matcher named " + name)
+	}
+
+	matchers := make([]Matcher, 0, len(l.names)-1)
+	for _, n := range l.names {
+		if n != name {
+			matchers = append(matchers, l.matchers[n])
+		}
+	}
+	return build(matchers, l, "")
+}
+
+// ReplaceMatcher returns a new Lexer where m takes the place of the matcher with the same name.
+func (l *Lexer) ReplaceMatcher(m Matcher) (*Lexer, error) {
+	if _, ok := l.matchers[m.Name()]; !ok {
+		return nil, errors.New("lexer: there is no matcher named " + m.Name())
+	}
+
+	matchers := l.Matchers()
+	for i, n := range l.names {
+		if n == m.Name() {
+			matchers[i] = m
+		}
+	}
+	return build(matchers, l, m.Name())
+}
+
+// Matchers returns the matchers used by l, in the order they are tried.
+func (l *Lexer) Matchers() []Matcher {
+	ret := make([]Matcher, len(l.names))
+	for i, name := range l.names {
+		ret[i] = l.matchers[name]
+	}
+	return ret
+}
+
+// compile compiles the expressions of a single matcher.
+func compile(matcher Matcher) ([]*compiledExpr, error) {
+	ret := make([]*compiledExpr, len(matcher.Exprs()))
+	for i, expr := range matcher.Exprs() {
+		var argExpr, realExpr string
+		if expr.CloseExpr != "" {
+			closeExpr := expr.CloseExpr
+			if expr.Flags&RequireClose == 0 {
+				closeExpr = "(?:" + expr.CloseExpr + ")|$"
+			}
+
+			var bodyExpr, rBodyExpr string
+			if expr.Flags&BodyAsArg != 0 {
+				bodyExpr += "?:"
+			}
+			if expr.Flags&NoNewline == 0 {
+				bodyExpr += "(?s)"
+				rBodyExpr += "(?s)"
+			}
+
+			body := ".*?"
+			if expr.BodyExpr != "" {
+				body = "(?:" + expr.BodyExpr + ")"
+			}
+			argExpr = fmt.Sprintf("(?:%s)(%s%s)(?:%s)", expr.Expr, bodyExpr, body, closeExpr)
+			realExpr = fmt.Sprintf("(?:%s)(?P<_i%02x%s>%s%s)(?:%s)",
+				expr.Expr, i, matcher.Name(), rBodyExpr, body, closeExpr)
+		} else {
+			argExpr = "(?:" + expr.Expr + ")(?-imsU)"
+			realExpr = "(?:" + expr.Expr + ")(?-imsU)"
+		}
+
+		re, err := regexp.Compile(argExpr)
+		if err != nil {
+			return nil, err
+		}
+
+		idByName := make(map[string]int)
+		for id, subexpName := range re.SubexpNames() {
+			if subexpName != "" && subexpName[0] == '_' {
+				return nil, errors.New("lexer: capture group names starting with _ are reserved for use by the lexer! Your name is " + subexpName)
+			}
+			if subexpName != "" {
+				idByName[subexpName] = id
+			}
+		}
+
+		ret[i] = &compiledExpr{re, idByName, fmt.Sprintf("(?P<_%02x%s>%s)", i, matcher.Name(), realExpr)}
+	}
+	return ret, nil
+}
+
+// build creates a Lexer from matchers. The compiled expressions of prev are reused for
+// every matcher except the one named changed.
+func build(matchers []Matcher, prev *Lexer, changed string) (*Lexer, error) {
 	l := &Lexer{
+		names:      make([]string, 0, len(matchers)),
 		matchers:   make(map[string]Matcher),
-		regexps:    make(map[string][]*regexp.Regexp),
+		compiled:   make(map[string][]*compiledExpr),
 		subexpIds:  make(map[string][]int),
 		bodyExpIds: make(map[string][]int),
 	}
 
+	subexprs := make([]string, 0)
 	for _, matcher := range matchers {
-		l.matchers[matcher.Name()] = matcher
-
-		numExprs := len(matcher.Exprs())
-		l.regexps[matcher.Name()] = make([]*regexp.Regexp, numExprs, numExprs)
-		l.subexpIds[matcher.Name()] = make([]int, numExprs, numExprs)
-		l.bodyExpIds[matcher.Name()] = make([]int, numExprs, numExprs)
-		for i, expr := range matcher.Exprs() {
-			var argExpr, realExpr string
-			if expr.CloseExpr != "" {
-				closeExpr := expr.CloseExpr
-				if expr.Flags&RequireClose == 0 {
-					closeExpr = "(?:" + expr.CloseExpr + ")|$"
-				}
-
-				var bodyExpr, rBodyExpr string
-				if expr.Flags&BodyAsArg != 0 {
-					bodyExpr += "?:"
-				}
-				if expr.Flags&NoNewline == 0 {
-					bodyExpr += "(?s)"
-					rBodyExpr += "(?s)"
-				}
-
-				argExpr = fmt.Sprintf("(?:%s)(%s.*?)(?:%s)", expr.Expr, bodyExpr, closeExpr)
-				realExpr = fmt.Sprintf("(?:%s)(?P<_i%02x%s>%s.*?)(?:%s)",
-					expr.Expr, i, matcher.Name(), rBodyExpr, closeExpr)
-			} else {
-				argExpr = "(?:" + expr.Expr + ")(?-imsU)"
-				realExpr = "(?:" + expr.Expr + ")(?-imsU)"
-			}
+		name := matcher.Name()
+		if _, ok := l.matchers[name]; ok {
+			return nil, errors.New("lexer: more than one matcher is named " + name)
+		}
+		l.names = append(l.names, name)
+		l.matchers[name] = matcher
 
-			l.regexps[matcher.Name()][i], err = regexp.Compile(argExpr)
+		if prev != nil && name != changed && prev.compiled[name] != nil {
+			l.compiled[name] = prev.compiled[name]
+		} else {
+			compiled, err := compile(matcher)
 			if err != nil {
 				return nil, err
 			}
+			l.compiled[name] = compiled
+		}
 
-			for _, subexpName := range l.regexps[matcher.Name()][i].SubexpNames() {
-				if subexpName != "" && subexpName[0] == '_' {
-					return nil, errors.New("lexer: capture group names starting with _ are reserved for use by the lexer! Your name is " + subexpName)
-				}
-			}
-
-			l.expr += fmt.Sprintf("(?P<_%02x%s>%s)|", i, matcher.Name(), realExpr)
+		numExprs := len(l.compiled[name])
+		l.subexpIds[name] = make([]int, numExprs, numExprs)
+		l.bodyExpIds[name] = make([]int, numExprs, numExprs)
+		for _, c := range l.compiled[name] {
+			subexprs = append(subexprs, c.subexpr)
 		}
 	}
 
-	l.expr = l.expr[:len(l.expr)-1] // Cut off the trailing '|'
+	if len(subexprs) == 0 {
+		return l, nil
+	}
+
+	var err error
+	l.expr = strings.Join(subexprs, "|")
 	l.regexp, err = regexp.Compile(l.expr)
 	if err != nil {
 		return nil, err
 	}
+	parsed, err := syntax.Parse(l.expr, syntax.Perl)
+	if err != nil {
+		return nil, err
+	}
+	l.prog, err = syntax.Compile(parsed.Simplify())
+	if err != nil {
+		return nil, err
+	}
 
 	for i, name := range l.regexp.SubexpNames() {
 		if name != "" && name[0] == '_' {
@@ -149,61 +290,216 @@ func New(matchers ...Matcher) (*Lexer, error) {
  * Converts an input string into Tokens.
  */
 func (l *Lexer) Tokenize(data string) []token.Token {
-	ret := make([]token.Token, 0)
-	toAppend := ""
-
-	for data != "" {
-		indices := l.regexp.FindStringSubmatchIndex(data)
-		if indices == nil {
-			ret = append(ret, token.TextToken{toAppend + data})
-			break
+	return l.TokenizeWith(data, nil)
+}
+
+// TokenizeWith converts data into Tokens like Tokenize, but only uses the matchers perms allows,
+// which are checked like permission.Set.AllowsAlias for AliasMatchers.
+// The matches of the others are left as text or stripped, depending on perms.Denied, except for
+// their bodies, which are tokenized as if they weren't in a match.
+func (l *Lexer) TokenizeWith(data string, perms *permission.Set) []token.Token {
+	tokens, _ := l.TokenizeContext(parsectx.WithPermissions(context.Background(), perms), data)
+	return tokens
+}
+
+// TokenizeContext converts data into Tokens like TokenizeWith, using the permissions in ctx.
+// ctx is passed to the ContextMatchers, and if it is done before data is tokenized, its error
+// is returned.
+func (l *Lexer) TokenizeContext(ctx context.Context, data string) ([]token.Token, error) {
+	r := l.newRun(ctx, data)
+	if err := r.tokenize(); err != nil {
+		return nil, err
+	}
+	return r.tokens, nil
+}
+
+// A run is the state of the lexer while it tokenizes an input.
+type run struct {
+	l       *Lexer
+	input   string
+	tokens  []token.Token
+	pending string // Text that will become the next TextToken
+	ctx     context.Context
+	perms   *permission.Set // The permissions in ctx
+	nested  bool            // Whether input is the body of a match, so LineStart matches can't start in it
+	midLine bool            // Whether input starts in the middle of a line
+}
+
+func (l *Lexer) newRun(ctx context.Context, input string) *run {
+	return &run{l: l, input: input, tokens: make([]token.Token, 0), ctx: ctx, perms: parsectx.Permissions(ctx)}
+}
+
+// tokenize tokenizes all of r.input, or returns ctx's error if it is done first.
+func (r *run) tokenize() error {
+	for pos := 0; pos < len(r.input); {
+		var err error
+		if pos, _, err = r.step(pos); err != nil {
+			return err
 		}
+	}
+	r.flush()
+	return nil
+}
 
-		for name, matcher := range l.matchers {
-			for expNum, i := range l.subexpIds[name] {
-				if i != 0 && indices[i*2] >= 0 {
-					if indices[i*2] != 0 {
-						toAppend += data[:indices[i*2]]
-					}
+// startsLine returns whether a LineStart match may start at i in r.input.
+func (r *run) startsLine(i int) bool {
+	if r.nested {
+		return false
+	}
+	if i == 0 {
+		return !r.midLine
+	}
+	return r.input[i-1] == '\n'
+}
+
+func (r *run) flush() {
+	if r.pending != "" {
+		r.tokens = append(r.tokens, token.NewTextToken(r.pending))
+		r.pending = ""
+	}
+}
+
+// step tokenizes the first match in r.input at or after pos and the text before it. It returns
+// where the next step starts, and where the match started or len(r.input) if there wasn't one.
+// If r.ctx is done before the step or while tokenizing the body of the match, its error is returned.
+func (r *run) step(pos int) (next, start int, err error) {
+	if err := r.ctx.Err(); err != nil {
+		return 0, 0, err
+	}
+	l := r.l
+	data := r.input[pos:]
+
+	var indices []int
+	if l.regexp != nil {
+		indices = l.regexp.FindStringSubmatchIndex(data)
+	}
+	if indices == nil {
+		r.pending += data
+		return len(r.input), len(r.input), nil
+	}
+
+	for _, name := range l.names {
+		matcher := l.matchers[name]
+		for expNum, i := range l.subexpIds[name] {
+			if i == 0 || indices[i*2] < 0 {
+				continue
+			}
+			r.pending += data[:indices[i*2]]
+
+			compiled := l.compiled[name][expNum]
+			args := compiled.regexp.FindStringSubmatch(data[indices[0]:indices[1]])
+
+			tokenArgs := token.NewTokenArgs(args, compiled.idByName)
 
-					args := l.regexps[name][expNum].FindStringSubmatch(data[indices[0]:indices[1]])
-
-					tokenArgs := token.NewTokenArgs(args, l.regexps[name][expNum].SubexpNames())
-
-					if matcher.IsValid(tokenArgs, expNum) {
-						openToken, closeToken := matcher.BuildToken(tokenArgs, expNum)
-
-						if openToken != nil {
-							if toAppend != "" {
-								ret = append(ret, token.TextToken{toAppend})
-							}
-							ret = append(ret, openToken)
-						}
-
-						bodyExpId := l.bodyExpIds[name][expNum]
-						if matcher.Exprs()[expNum].Flags&(NoParseInner|BodyAsArg) == 0 && bodyExpId != 0 {
-							ret = append(ret, l.Tokenize(data[indices[bodyExpId*2]:indices[bodyExpId*2+1]])...)
-						} else {
-							toAppend += data[indices[bodyExpId*2]:indices[bodyExpId*2+1]]
-						}
-
-						if closeToken != nil {
-							if toAppend != "" {
-								ret = append(ret, token.TextToken{toAppend})
-								toAppend = ""
-							}
-							ret = append(ret, closeToken)
-						}
-
-						data = data[indices[i*2+1]:]
-					} else {
-						toAppend += data[:1]
-						data = data[1:]
+			flags := matcher.Exprs()[expNum].Flags
+			if flags&LineStart != 0 && !r.startsLine(pos+indices[i*2]) || !r.isValid(matcher, tokenArgs, expNum) {
+				r.pending += data[indices[i*2] : indices[i*2]+1]
+				return pos + indices[i*2] + 1, pos + indices[i*2], nil
+			}
+
+			bodyExpId := l.bodyExpIds[name][expNum]
+			if !r.allows(matcher) {
+				if err := r.deny(pos, indices, i, bodyExpId); err != nil {
+					return 0, 0, err
+				}
+				return pos + r.matchEnd(data, indices[i*2+1]), pos + indices[i*2], nil
+			}
+
+			openToken, closeToken := r.buildToken(matcher, tokenArgs, expNum)
+
+			if openToken != nil {
+				r.flush()
+				r.tokens = append(r.tokens, openToken)
+			}
+
+			if bodyExpId != 0 {
+				body := data[indices[bodyExpId*2]:indices[bodyExpId*2+1]]
+				if flags&(NoParseInner|BodyAsArg) == 0 {
+					r.flush()
+					inner := l.newRun(r.ctx, body)
+					inner.nested = true
+					if err := inner.tokenize(); err != nil {
+						return 0, 0, err
 					}
+					r.tokens = append(r.tokens, inner.tokens...)
+				} else {
+					r.pending += body
 				}
 			}
+
+			if closeToken != nil {
+				r.flush()
+				r.tokens = append(r.tokens, closeToken)
+			}
+
+			return pos + r.matchEnd(data, indices[i*2+1]), pos + indices[i*2], nil
 		}
 	}
+	panic("lexer: the regexp matched, but none of the matchers did")
+}
+
+// matchEnd returns where the step for a match in data that ended at end finishes. A match that
+// is empty and at the start of data would be found again by the next step, so the rune after
+// it is added as text.
+func (r *run) matchEnd(data string, end int) int {
+	if end == 0 && data != "" {
+		_, end = utf8.DecodeRuneInString(data)
+		r.pending += data[:end]
+	}
+	return end
+}
 
-	return ret
+// allows returns whether r.perms allows m, or the tag it is for if it is an AliasMatcher.
+func (r *run) allows(m Matcher) bool {
+	if am, ok := m.(AliasMatcher); ok {
+		return r.perms.AllowsAlias(m.Name(), am.Alias())
+	}
+	return r.perms.Allows(m.Name())
+}
+
+func (r *run) isValid(m Matcher, args *token.TokenArgs, expNum int) bool {
+	if cm, ok := m.(ContextMatcher); ok {
+		return cm.IsValidContext(r.ctx, args, expNum)
+	}
+	return m.IsValid(args, expNum)
+}
+
+func (r *run) buildToken(m Matcher, args *token.TokenArgs, expNum int) (token.Token, token.Token) {
+	if cm, ok := m.(ContextMatcher); ok {
+		return cm.BuildTokenContext(r.ctx, args, expNum)
+	}
+	return m.BuildToken(args, expNum)
+}
+
+// deny tokenizes a match in r.input after pos of a matcher that r.perms denies, given the indices
+// of its submatches, the id of the whole match and the id of its body, or 0 if it has none. The text
+// around the body is added as text or dropped, and the body is tokenized whatever the matcher's
+// Flags are, since it isn't in a match any more. If r.ctx is done before that, its error is returned.
+func (r *run) deny(pos int, indices []int, id, bodyExpId int) error {
+	data := r.input[pos:]
+	start, end := indices[id*2], indices[id*2+1]
+	bodyStart, bodyEnd := end, end
+	if bodyExpId != 0 && indices[bodyExpId*2] >= 0 {
+		bodyStart, bodyEnd = indices[bodyExpId*2], indices[bodyExpId*2+1]
+	}
+	if !r.perms.Strips() {
+		r.pending += data[start:bodyStart]
+	}
+
+	body := data[bodyStart:bodyEnd]
+	inner := r.l.newRun(r.ctx, body)
+	inner.tokens, inner.pending = r.tokens, r.pending
+	inner.nested, inner.midLine = r.nested, !r.startsLine(pos+bodyStart)
+	for pos := 0; pos < len(body); {
+		var err error
+		if pos, _, err = inner.step(pos); err != nil {
+			return err
+		}
+	}
+	r.tokens, r.pending = inner.tokens, inner.pending
+
+	if !r.perms.Strips() {
+		r.pending += data[bodyEnd:end]
+	}
+	return nil
 }
@@ -2,8 +2,14 @@ package lexer_test
 
 import (
 	"."
+	"context"
 	"fmt"
+	"github.com/moechat/parser/parsectx"
+	"github.com/moechat/parser/permission"
 	"github.com/moechat/parser/token"
+	"math/rand"
+	"reflect"
+	"strings"
 	"testing"
 )
 
@@ -37,9 +43,9 @@ func (tm *TestMatcher) BuildToken(args *token.TokenArgs, expNum int) (token.Toke
 			title = args.ById(2)
 		}
 		// Yes, this would be unsafe in a production environment. But it's a testing script.
-		return token.TextToken{fmt.Sprintf(`<img src="%s" title="%s">`, url, title)}, nil
+		return token.NewTextToken(fmt.Sprintf(`<img src="%s" title="%s">`, url, title)), nil
 	} else if tm.name == "bold" {
-		return token.TextToken{"<b>"}, token.TextToken{"</b>"}
+		return token.NewTextToken("<b>"), token.NewTextToken("</b>")
 	}
 	return nil, nil
 }
@@ -64,7 +70,8 @@ func TestLexer(*testing.T) {
 `
 
 	for _, t := range l.Tokenize(toTokenize) {
-		fmt.Print(t.(token.TextToken).Body)
+		out, _ := t.(*token.TextToken).Output()
+		fmt.Print(out)
 	}
 	fmt.Println()
 
@@ -73,3 +80,377 @@ func TestLexer(*testing.T) {
 	// [img]http://fail.com/fun.png[/img]great.
 	// </b>
 }
+
+func render(tokens []token.Token) string {
+	ret := ""
+	for _, t := range tokens {
+		out, _ := t.(*token.TextToken).Output()
+		ret += out
+	}
+	return ret
+}
+
+func TestLexerSnapshots(t *testing.T) {
+	bold := &TestMatcher{"bold", []lexer.Expression{
+		{Expr: `\[b\]`, CloseExpr: `\[/b\]`},
+	}}
+	l := lexer.Must(lexer.New(bold))
+
+	withImage, err := l.AddMatcher(&TestMatcher{"image", []lexer.Expression{
+		{Expr: `\[img=(.*?)\]`},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err := withImage.AddMatcher(bold); err == nil {
+		t.Error("Adding a matcher with a duplicate name should fail")
+	}
+
+	input := "[b]hi[/b][img=a.png]"
+	if out := render(l.Tokenize(input)); out != "<b>hi</b>[img=a.png]" {
+		t.Errorf("Original lexer changed by AddMatcher, output is %q", out)
+	}
+	if out := render(withImage.Tokenize(input)); out != `<b>hi</b><img src="a.png" title="a.png">` {
+		t.Errorf("AddMatcher output is %q", out)
+	}
+
+	replaced, err := withImage.ReplaceMatcher(&TestMatcher{"bold", []lexer.Expression{
+		{Expr: `\*\*`, CloseExpr: `\*\*`},
+	}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := render(replaced.Tokenize("**hi** [b]")); out != "<b>hi</b> [b]" {
+		t.Errorf("ReplaceMatcher output is %q", out)
+	}
+
+	removed, err := replaced.RemoveMatcher("image")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := render(removed.Tokenize(input)); out != input {
+		t.Errorf("RemoveMatcher output is %q", out)
+	}
+	if _, err := removed.RemoveMatcher("image"); err == nil {
+		t.Error("Removing a missing matcher should fail")
+	}
+
+	empty := lexer.Must(removed.RemoveMatcher("bold"))
+	if out := render(empty.Tokenize(input)); out != input {
+		t.Errorf("A lexer with no matchers output %q", out)
+	}
+}
+
+// A tagMatcher produces TagTokens for a single expression, rejecting matches with nothing inside them.
+type tagMatcher struct {
+	name string
+	expr lexer.Expression
+}
+
+func (tm *tagMatcher) Name() string {
+	return tm.name
+}
+
+func (tm *tagMatcher) Exprs() []lexer.Expression {
+	return []lexer.Expression{tm.expr}
+}
+
+func (tm *tagMatcher) IsValid(args *token.TokenArgs, expNum int) bool {
+	return tm.expr.CloseExpr == "" || args.ById(1) != ""
+}
+
+func (tm *tagMatcher) BuildToken(args *token.TokenArgs, expNum int) (token.Token, token.Token) {
+	return token.NewTagToken(token.OpenToken, tm.name, []string{args.ById(0)}),
+		token.NewTagToken(token.CloseToken, tm.name, nil)
+}
+
+// An argsMatcher renders its matches' args, to show what the lexer captured.
+type argsMatcher struct {
+	tagMatcher
+}
+
+func (am *argsMatcher) IsValid(args *token.TokenArgs, expNum int) bool {
+	return true
+}
+
+func (am *argsMatcher) BuildToken(args *token.TokenArgs, expNum int) (token.Token, token.Token) {
+	captured := make([]string, args.Size()-1)
+	for i := range captured {
+		captured[i] = args.ById(i + 1)
+	}
+	return token.NewTextToken(fmt.Sprintf("<%s %q>", am.name, captured)), token.NewTextToken("</" + am.name + ">")
+}
+
+func TestBodies(t *testing.T) {
+	l := lexer.Must(lexer.New(
+		&argsMatcher{tagMatcher{"b", lexer.Expression{Expr: `\[b\]`, CloseExpr: `\[/b\]`}}},
+		&argsMatcher{tagMatcher{"i", lexer.Expression{Expr: `\[i=(\w+)\]`, CloseExpr: `\[/i\]`}}},
+		&argsMatcher{tagMatcher{"img", lexer.Expression{Expr: `\[img\]`, CloseExpr: `\[/img\]`, Flags: lexer.BodyAsArg}}},
+		&argsMatcher{tagMatcher{"nope", lexer.Expression{Expr: `\[nope\]`, CloseExpr: `\[/nope\]`, Flags: lexer.NoParseInner}}},
+		&argsMatcher{tagMatcher{"q", lexer.Expression{Expr: `<`, CloseExpr: `>`, BodyExpr: `(?:[^"]|"[^"]*")*?`}}},
+	))
+
+	// Bodies are captured as the last arg, except with BodyAsArg, and only parsed without either flag
+	tests := map[string]string{
+		"[b]x [i=y]z[/i][/b]":   `<b ["x [i=y]z[/i]"]>x <i ["y" "z"]>z</i></b>`,
+		"[img]a.png[/img]":      `<img []>a.png</img>`,
+		"[nope][b]x[/b][/nope]": `<nope ["[b]x[/b]"]>[b]x[/b]</nope>`,
+		`<a ">" b> c>`:          `<q ["a \">\" b"]>a ">" b</q> c>`,
+	}
+	for input, expected := range tests {
+		if out := render(l.Tokenize(input)); out != expected {
+			t.Errorf("%q tokenized as %q, expected %q", input, out, expected)
+		}
+	}
+}
+
+func TestEmptyMatches(t *testing.T) {
+	// Matches that are empty can't stop the lexer from moving on
+	l := lexer.Must(lexer.New(&TestMatcher{"empty", []lexer.Expression{{Expr: `x?`}}}))
+	input := "ab xé"
+	tokens := l.Tokenize(input)
+	if out := render(tokens); out != "ab é" {
+		t.Errorf("%q tokenized as %q", input, out)
+	}
+	if !reflect.DeepEqual(l.Lex(input).Tokens, tokens) {
+		t.Error("Lex doesn't match Tokenize")
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	l := lexer.Must(lexer.New(
+		&TestMatcher{"bold", []lexer.Expression{
+			{Expr: `\[b\]`, CloseExpr: `\[/b\]`},
+		}},
+		&TestMatcher{"image", []lexer.Expression{
+			{Expr: `\[img=(.*?)\]`},
+		}},
+		&TestMatcher{"noparse", []lexer.Expression{
+			{Expr: `\[nope\]`, CloseExpr: `\[/nope\]`, Flags: lexer.NoParseInner},
+		}},
+	))
+	input := "[b]x [img=a.png][/b] [nope][b]y[/b][/nope]"
+	strip := permission.Deny("bold", "noparse")
+	strip.Denied = permission.Strip
+
+	tests := []struct {
+		perms    *permission.Set
+		expected string
+	}{
+		{nil, `<b>x <img src="a.png" title="a.png"></b> [b]y[/b]`},
+		{permission.Deny("bold"), `[b]x <img src="a.png" title="a.png">[/b] [b]y[/b]`},
+		{permission.Allow("bold"), `<b>x [img=a.png]</b> [nope]<b>y</b>[/nope]`},
+		{strip, `x <img src="a.png" title="a.png"> y`},
+	}
+	for _, test := range tests {
+		tokens := l.TokenizeWith(input, test.perms)
+		if out := render(tokens); out != test.expected {
+			t.Errorf("%q with %+v tokenized as %q, expected %q", input, test.perms, out, test.expected)
+		}
+		if !reflect.DeepEqual(l.LexWith(input, test.perms).Tokens, tokens) {
+			t.Errorf("LexWith doesn't match TokenizeWith with %+v", test.perms)
+		}
+	}
+}
+
+// An aliasMatcher is an argsMatcher for the tag named alias.
+type aliasMatcher struct {
+	*argsMatcher
+	alias string
+}
+
+func (am aliasMatcher) Alias() string {
+	return am.alias
+}
+
+func TestAliases(t *testing.T) {
+	l := lexer.Must(lexer.New(
+		aliasMatcher{&argsMatcher{tagMatcher{"md_bold", lexer.Expression{Expr: `\*\*`, CloseExpr: `\*\*`}}}, "b"},
+		aliasMatcher{&argsMatcher{tagMatcher{"italic", lexer.Expression{Expr: `_`, CloseExpr: `_`}}}, ""},
+	))
+	input := "**x** _y_"
+	allowBold := permission.Allow("italic")
+	allowBold.Names["md_bold"] = true
+
+	tests := []struct {
+		perms    *permission.Set
+		expected string
+	}{
+		{permission.Deny("b"), `**x** <italic ["y"]>y</italic>`},
+		{permission.Allow("b", "italic"), `<md_bold ["x"]>x</md_bold> <italic ["y"]>y</italic>`},
+		{permission.Allow("italic"), `**x** <italic ["y"]>y</italic>`},
+		{allowBold, `<md_bold ["x"]>x</md_bold> <italic ["y"]>y</italic>`},
+		{permission.Deny("md_bold"), `**x** <italic ["y"]>y</italic>`},
+	}
+	for _, test := range tests {
+		if out := render(l.TokenizeWith(input, test.perms)); out != test.expected {
+			t.Errorf("%q with %+v tokenized as %q, expected %q", input, test.perms, out, test.expected)
+		}
+	}
+}
+
+// A mentionMatcher links @mentions of anyone but the message's author.
+type mentionMatcher struct{}
+
+func (mentionMatcher) Name() string { return "mention" }
+
+func (mentionMatcher) Exprs() []lexer.Expression {
+	return []lexer.Expression{{Expr: `@(\w+)`}}
+}
+
+func (mentionMatcher) IsValid(args *token.TokenArgs, expNum int) bool { return true }
+
+func (mentionMatcher) BuildToken(args *token.TokenArgs, expNum int) (token.Token, token.Token) {
+	return token.NewTextToken("<u>@" + args.ById(1) + "</u>"), nil
+}
+
+func (mentionMatcher) IsValidContext(ctx context.Context, args *token.TokenArgs, expNum int) bool {
+	return args.ById(1) != parsectx.Author(ctx)
+}
+
+func (mentionMatcher) BuildTokenContext(ctx context.Context, args *token.TokenArgs, expNum int) (token.Token, token.Token) {
+	return token.NewTextToken(`<a href="/rooms/` + parsectx.Room(ctx) + `/users/` + args.ById(1) + `">@` + args.ById(1) + "</a>"), nil
+}
+
+func TestContext(t *testing.T) {
+	l := lexer.Must(lexer.New(
+		&TestMatcher{"bold", []lexer.Expression{
+			{Expr: `\[b\]`, CloseExpr: `\[/b\]`},
+		}},
+		mentionMatcher{},
+	))
+	input := "[b]@amy[/b] and @bo"
+	ctx := parsectx.WithRoom(parsectx.WithAuthor(context.Background(), "bo"), "7")
+	expected := `<b><a href="/rooms/7/users/amy">@amy</a></b> and @bo`
+
+	tokens, err := l.TokenizeContext(ctx, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := render(tokens); out != expected {
+		t.Errorf("%q tokenized as %q, expected %q", input, out, expected)
+	}
+
+	res, err := l.LexContext(ctx, input)
+	if err != nil {
+		t.Fatal(err)
+	}
+	e := lexer.Edit{Offset: len(input), Inserted: " @cy"}
+	res, err = l.Relex(res, e)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out := render(res.Tokens); out != expected+` <a href="/rooms/7/users/cy">@cy</a>` {
+		t.Errorf("%q relexed as %q", res.Input, out)
+	}
+
+	cancelled, cancel := context.WithCancel(ctx)
+	res, _ = l.LexContext(cancelled, input)
+	cancel()
+	if _, err := l.TokenizeContext(cancelled, input); err != context.Canceled {
+		t.Errorf("Tokenizing in a cancelled context returned %v", err)
+	}
+	if _, err := l.Relex(res, e); err != context.Canceled {
+		t.Errorf("Relexing in a cancelled context returned %v", err)
+	}
+}
+
+// A cancelMatcher is a mentionMatcher that cancels the parse when it matches, like a slow
+// matcher running out of time would.
+type cancelMatcher struct {
+	mentionMatcher
+	cancel context.CancelFunc
+}
+
+func (cm cancelMatcher) IsValidContext(ctx context.Context, args *token.TokenArgs, expNum int) bool {
+	cm.cancel()
+	return true
+}
+
+func TestCancelInBody(t *testing.T) {
+	// A context that is done while the body of a match is tokenized stops the whole run
+	matchers := func(cancel context.CancelFunc) *lexer.Lexer {
+		return lexer.Must(lexer.New(
+			&TestMatcher{"bold", []lexer.Expression{{Expr: `\[b\]`, CloseExpr: `\[/b\]`}}},
+			cancelMatcher{cancel: cancel},
+		))
+	}
+	input := "[b]@amy @bo @cy[/b]"
+
+	ctx, cancel := context.WithCancel(context.Background())
+	if tokens, err := matchers(cancel).TokenizeContext(ctx, input); err != context.Canceled || tokens != nil {
+		t.Errorf("Cancelling while tokenizing a body gave %v, %v", tokens, err)
+	}
+	ctx, cancel = context.WithCancel(context.Background())
+	if res, err := matchers(cancel).LexContext(ctx, input); err != context.Canceled || res != nil {
+		t.Errorf("Cancelling while lexing a body gave %v, %v", res, err)
+	}
+	ctx, cancel = context.WithCancel(parsectx.WithPermissions(context.Background(), permission.Deny("bold")))
+	if tokens, err := matchers(cancel).TokenizeContext(ctx, input); err != context.Canceled || tokens != nil {
+		t.Errorf("Cancelling while tokenizing a denied body gave %v, %v", tokens, err)
+	}
+}
+
+func TestRelex(t *testing.T) {
+	l := lexer.Must(lexer.New(
+		&TestMatcher{"bold", []lexer.Expression{
+			{Expr: `\[b\]`, CloseExpr: `\[/b\]`},
+		}},
+		&TestMatcher{"image", []lexer.Expression{
+			{Expr: `\[img=(.*?)\]`},
+		}},
+		&tagMatcher{"code", lexer.Expression{Expr: "`", CloseExpr: "`", Flags: lexer.NoParseInner | lexer.NoNewline | lexer.RequireClose}},
+		&tagMatcher{"strike", lexer.Expression{Expr: "~~", CloseExpr: "~~", Flags: lexer.BodyAsArg | lexer.RequireClose}},
+		&tagMatcher{"quote", lexer.Expression{Expr: "(?m:^)> ", CloseExpr: "\n", Flags: lexer.LineStart}},
+		&tagMatcher{"word", lexer.Expression{Expr: `\bwho\b`}},
+	))
+
+	prev := l.Lex("[b]hi[/b] there, [img=a.png] who ~~is~~ `here`")
+	next, err := l.Relex(prev, lexer.Edit{Offset: len(prev.Input), Inserted: "?"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if next.Input != prev.Input+"?" {
+		t.Errorf("Relex's input is %q", next.Input)
+	}
+	if next.Tokens[0] != prev.Tokens[0] {
+		t.Error("Relex lexed the start of the input again after an edit at the end")
+	}
+	if _, err := l.Relex(prev, lexer.Edit{Offset: len(prev.Input), Deleted: 1}); err == nil {
+		t.Error("Relex accepted an edit outside of the input")
+	}
+
+	// Relex has to give the same tokens as lexing the whole input again
+	pieces := []string{"[b]", "[/b]", "[img=", "]", "`", "~~", "> ", "\n", "who", "whom", " ", "a", "é", "\xc3", "["}
+	random := func(r *rand.Rand, n int) string {
+		var s strings.Builder
+		for i := 0; i < n; i++ {
+			s.WriteString(pieces[r.Intn(len(pieces))])
+		}
+		return s.String()
+	}
+	strip := permission.Deny("bold", "code")
+	strip.Denied = permission.Strip
+	perms := []*permission.Set{nil, permission.Deny("strike", "quote"), strip}
+	r := rand.New(rand.NewSource(42))
+	for i := 0; i < 200; i++ {
+		res := l.LexWith(random(r, r.Intn(30)), perms[i%len(perms)])
+		for j := 0; j < 20; j++ {
+			e := lexer.Edit{Offset: r.Intn(len(res.Input) + 1), Inserted: random(r, r.Intn(3))}
+			e.Deleted = r.Intn(len(res.Input) - e.Offset + 1)
+			if e.Deleted > 5 {
+				e.Deleted = 5
+			}
+
+			next, err := l.Relex(res, e)
+			if err != nil {
+				t.Fatal(err)
+			}
+			expected := l.TokenizeWith(next.Input, perms[i%len(perms)])
+			if !reflect.DeepEqual(next.Tokens, expected) {
+				t.Fatalf("Relexing %q with %+v gave %v, expected %v", res.Input, e, next.Tokens, expected)
+			}
+			res = next
+		}
+	}
+}
@@ -0,0 +1,268 @@
+package lexer
+
+import (
+	"context"
+	"errors"
+	"github.com/moechat/parser/parsectx"
+	"github.com/moechat/parser/permission"
+	"github.com/moechat/parser/token"
+	"regexp/syntax"
+	"sort"
+	"unicode/utf8"
+)
+
+/*
+ * A Result is the output of Lex: the tokens for an input, along with what Relex
+ * needs to update them after the input is edited.
+ *
+ * The lexer works through its input in steps, each of which searches for the next
+ * match and turns it and the text before it into tokens. A step's tokens only depend
+ * on the input from just before where it starts, so Relex keeps the steps the edit can't have
+ * changed, re-lexes from the first one it might have, and stops as soon as it is back
+ * in step with the old tokens after the edit.
+ */
+type Result struct {
+	Input  string
+	Tokens []token.Token
+
+	ctx   context.Context // The context the input was lexed in, which Relex uses too
+	steps []step
+}
+
+// A step is a single search for a match made while lexing a Result's Input.
+type step struct {
+	pos     int // Where the search started
+	start   int // Where the match started, or len(Input) if there was none
+	tokens  int // len(Tokens) when the step started
+	pending int // How much text was waiting to become a TextToken when the step started; it's the start of Tokens[tokens]
+	horizon int // How far the search may have looked into Input, or -1 if that hasn't been worked out yet
+}
+
+// An Edit replaces Deleted bytes of an input starting at Offset with Inserted.
+type Edit struct {
+	Offset   int
+	Deleted  int
+	Inserted string
+}
+
+// Apply returns input with e applied to it.
+func (e Edit) Apply(input string) string {
+	return input[:e.Offset] + e.Inserted + input[e.Offset+e.Deleted:]
+}
+
+// Lex converts input into Tokens like Tokenize, and keeps what Relex needs to update them.
+func (l *Lexer) Lex(input string) *Result {
+	return l.LexWith(input, nil)
+}
+
+// LexWith is like Lex, but only uses the matchers perms allows, like TokenizeWith.
+// Relexing the Result keeps using perms.
+func (l *Lexer) LexWith(input string, perms *permission.Set) *Result {
+	res, _ := l.LexContext(parsectx.WithPermissions(context.Background(), perms), input)
+	return res
+}
+
+// LexContext is like Lex, but uses ctx like TokenizeContext. Relexing the Result keeps using ctx.
+func (l *Lexer) LexContext(ctx context.Context, input string) (*Result, error) {
+	r := l.newRun(ctx, input)
+	res := &Result{Input: input, ctx: ctx}
+	for pos := 0; pos < len(input); {
+		s := step{pos: pos, tokens: len(r.tokens), pending: len(r.pending), horizon: -1}
+		var err error
+		if pos, s.start, err = r.step(pos); err != nil {
+			return nil, err
+		}
+		res.steps = append(res.steps, s)
+	}
+	r.flush()
+	res.Tokens = r.tokens
+	return res, nil
+}
+
+// Relex returns the Result of lexing prev.Input after e has been applied to it. The tokens are
+// the same as Lex would return, but only the part of the input that e could have changed, and
+// the construct around it, is lexed again. Tokens that haven't changed are shared with prev.
+// The Matchers' IsValid and BuildToken methods must only depend on the text they are given
+// and the context prev was lexed in. If that context is done, its error is returned.
+func (l *Lexer) Relex(prev *Result, e Edit) (*Result, error) {
+	if e.Offset < 0 || e.Deleted < 0 || e.Offset+e.Deleted > len(prev.Input) {
+		return nil, errors.New("lexer: the edit is outside of the input")
+	}
+	input := e.Apply(prev.Input)
+	delta := len(e.Inserted) - e.Deleted
+
+	// The steps that never looked as far as the edit are kept
+	changed := e.Offset
+	for changed > 0 && changed < len(prev.Input) && !utf8.RuneStart(prev.Input[changed]) {
+		changed--
+	}
+	res := &Result{Input: input, ctx: prev.ctx}
+	kept := 0
+	for ; kept < len(prev.steps); kept++ {
+		s := prev.steps[kept]
+		if s.pos >= changed {
+			break
+		}
+		if s.horizon < 0 {
+			s.horizon = l.horizon(prev.Input, s.pos, s.start)
+		}
+		if s.horizon >= changed {
+			break
+		}
+		res.steps = append(res.steps, s)
+	}
+
+	r := l.newRun(prev.ctx, input)
+	pos := 0
+	if kept < len(prev.steps) {
+		s := prev.steps[kept]
+		pos = s.pos
+		r.tokens = append(r.tokens, prev.Tokens[:s.tokens]...)
+		r.pending = prev.pendingAt(s)
+	}
+
+	for pos < len(input) {
+		// After the edit, the input is the same as before, so once a step starts where one
+		// did before with the same text pending, the rest of the tokens are the same too
+		if pos > e.Offset+len(e.Inserted) {
+			i := sort.Search(len(prev.steps), func(i int) bool { return prev.steps[i].pos >= pos-delta })
+			if i < len(prev.steps) && prev.steps[i].pos == pos-delta && prev.pendingAt(prev.steps[i]) == r.pending {
+				old := prev.steps[i].tokens
+				for _, s := range prev.steps[i:] {
+					s.pos += delta
+					s.start += delta
+					s.tokens += len(r.tokens) - old
+					if s.horizon >= 0 {
+						s.horizon += delta
+					}
+					res.steps = append(res.steps, s)
+				}
+				res.Tokens = append(r.tokens, prev.Tokens[old:]...)
+				return res, nil
+			}
+		}
+
+		s := step{pos: pos, tokens: len(r.tokens), pending: len(r.pending), horizon: -1}
+		var err error
+		if pos, s.start, err = r.step(pos); err != nil {
+			return nil, err
+		}
+		res.steps = append(res.steps, s)
+	}
+	r.flush()
+	res.Tokens = r.tokens
+	return res, nil
+}
+
+// pendingAt returns the text that was waiting to become a TextToken when s started.
+func (res *Result) pendingAt(s step) string {
+	if s.pending == 0 {
+		return ""
+	}
+	text, _ := res.Tokens[s.tokens].(*token.TextToken).Output()
+	return text[:s.pending]
+}
+
+// A threadList is the set of instructions the regexp's threads are at, in priority order.
+type threadList struct {
+	pcs  []uint32
+	seen []int // The position each instruction was last added at
+}
+
+func newThreadList(size int) *threadList {
+	tl := &threadList{seen: make([]int, size)}
+	for i := range tl.seen {
+		tl.seen[i] = -1
+	}
+	return tl
+}
+
+// add adds a thread at pc, and the threads it leads to without reading any input, at position at.
+func (tl *threadList) add(prog *syntax.Prog, pc uint32, at int, context syntax.EmptyOp) {
+	if tl.seen[pc] == at {
+		return
+	}
+	tl.seen[pc] = at
+
+	switch inst := &prog.Inst[pc]; inst.Op {
+	case syntax.InstAlt, syntax.InstAltMatch:
+		tl.add(prog, inst.Out, at, context)
+		tl.add(prog, inst.Arg, at, context)
+	case syntax.InstCapture, syntax.InstNop:
+		tl.add(prog, inst.Out, at, context)
+	case syntax.InstEmptyWidth:
+		if syntax.EmptyOp(inst.Arg)&^context == 0 {
+			tl.add(prog, inst.Out, at, context)
+		}
+	case syntax.InstFail:
+	default:
+		tl.pcs = append(tl.pcs, pc)
+	}
+}
+
+func matchesRune(inst *syntax.Inst, r rune) bool {
+	switch inst.Op {
+	case syntax.InstRune, syntax.InstRune1:
+		return inst.MatchRune(r)
+	case syntax.InstRuneAny:
+		return true
+	case syntax.InstRuneAnyNotNL:
+		return r != '\n'
+	}
+	return false
+}
+
+/*
+ * horizon returns the furthest position in input that l's regexp may have looked at
+ * when searching input[pos:] found a match starting at start, or no match if start is
+ * len(input). If input is only changed after that, the search finds the same match.
+ *
+ * It runs the regexp's program like the regexp package's NFA does, following every
+ * thread that could still beat the match that was found.
+ */
+func (l *Lexer) horizon(input string, pos, start int) int {
+	if l.prog == nil {
+		return len(input)
+	}
+	prog := l.prog
+	clist, nlist := newThreadList(len(prog.Inst)), newThreadList(len(prog.Inst))
+	context := func(i int) syntax.EmptyOp {
+		before, after := rune(-1), rune(-1)
+		if i > pos {
+			before, _ = utf8.DecodeLastRuneInString(input[pos:i])
+		}
+		if i < len(input) {
+			after, _ = utf8.DecodeRuneInString(input[i:])
+		}
+		return syntax.EmptyOpContext(before, after)
+	}
+
+	horizon, matched := pos, false
+	for i := pos; ; {
+		if i <= start && !matched {
+			clist.add(prog, uint32(prog.Start), i, context(i))
+			horizon = i
+		}
+		if i == len(input) || len(clist.pcs) == 0 && (i >= start || matched) {
+			break
+		}
+
+		r, width := utf8.DecodeRuneInString(input[i:])
+		for _, pc := range clist.pcs {
+			inst := &prog.Inst[pc]
+			if inst.Op == syntax.InstMatch {
+				// The threads after this one have a lower priority, so they can't win
+				matched = true
+				break
+			}
+			if matchesRune(inst, r) {
+				nlist.add(prog, inst.Out, i+width, context(i+width))
+				horizon = i + width
+			}
+		}
+		clist, nlist = nlist, clist
+		nlist.pcs = nlist.pcs[:0]
+		i += width
+	}
+	return horizon
+}
@@ -0,0 +1,219 @@
+/*
+ * Package markdown is a set of lexer matchers for the markdown dialect used in chat:
+ *
+ *	`code`          inline code
+ *	```lang ...```  fenced code blocks, with an optional language
+ *	~~strike~~      strikethrough
+ *	__underline__   underline
+ *	> quote         a quote, to the end of the line, which must start a line outside of other markup
+ *	||spoiler||     a spoiler
+ *	\~~             an escaped delimiter, which is just text
+ *
+ * An escaped delimiter can't close anything either, so it is skipped for the next one, like
+ * a bbcode.Parser using Tags does: ||a \|| b|| is a spoiler of "a || b".
+ *
+ * Code beats everything else: nothing is parsed inside code, and no other markup
+ * may start outside a code span and end inside it, so closing delimiters inside code
+ * spans are skipped. The matchers produce token.TagTokens
+ * named after their delimiters, which are rendered by a bbcode.Parser using Tags.
+ * They can be combined with other matchers, i.e. from a BBCode ruleset, using Lexer.
+ */
+package markdown
+
+import (
+	"context"
+	"fmt"
+	"github.com/moechat/parser/bbcode"
+	"github.com/moechat/parser/lexer"
+	"github.com/moechat/parser/token"
+	"strings"
+)
+
+// A matcher is the lexer.Matcher for a single kind of markdown.
+type matcher struct {
+	name  string // The matcher's name, which must be unique among the lexer's matchers
+	delim string // The name of the tokens it produces
+	tag   string // The tag its permissions follow: the Alias of the tag named delim in Tags, or delim
+	expr  lexer.Expression
+	code  bool // Whether the matcher matches code, so doesn't need to be checked against code spans
+}
+
+var matchers = []*matcher{
+	// Fences go before inline code, since they start with the same character
+	{"md_fence", "```", "```", lexer.Expression{
+		Expr:      "```(?:([A-Za-z0-9_+#.-]+)[ \\t]*\\n|\\n?)",
+		CloseExpr: "\\n?```",
+		Flags:     lexer.NoParseInner | lexer.RequireClose,
+	}, true},
+	{"md_code", "`", "`", lexer.Expression{
+		Expr:      "`",
+		CloseExpr: "`",
+		Flags:     lexer.NoParseInner | lexer.NoNewline | lexer.RequireClose,
+	}, true},
+	{"md_spoiler", "||", "spoiler", lexer.Expression{Expr: `\|\|`, CloseExpr: `\|\|`, Flags: lexer.RequireClose}, false},
+	{"md_strike", "~~", "s", lexer.Expression{Expr: "~~", CloseExpr: "~~", Flags: lexer.RequireClose}, false},
+	{"md_underline", "__", "u", lexer.Expression{Expr: "__", CloseExpr: "__", Flags: lexer.RequireClose}, false},
+	{"md_quote", ">", "quote", lexer.Expression{Expr: "(?m:^)> ", CloseExpr: "\\n", Flags: lexer.LineStart}, false},
+}
+
+func (m *matcher) Name() string {
+	return m.name
+}
+
+// Alias returns the tag m's permissions follow, so denying [s] denies ~~ too, like in a bbcode.Parser.
+func (m *matcher) Alias() string {
+	return m.tag
+}
+
+func (m *matcher) Exprs() []lexer.Expression {
+	if m.code {
+		return []lexer.Expression{m.expr}
+	}
+	return []lexer.Expression{wholeCodeSpans(m.expr, 0)}
+}
+
+// IsValid doesn't need to check for split code spans, since the bodies of the matchers that
+// aren't for code only match whole ones.
+func (m *matcher) IsValid(args *token.TokenArgs, expNum int) bool {
+	// There must be something between the delimiters, i.e. not "~~~~"
+	return m.expr.Flags&lexer.RequireClose == 0 || len(args.ById(0)) > 2*len(m.delim)
+}
+
+func (m *matcher) BuildToken(args *token.TokenArgs, expNum int) (token.Token, token.Token) {
+	// The lexer captures the body as the last arg, so only a fence's language comes before it
+	lang := ""
+	if args.Size() > 2 {
+		lang = args.ById(1)
+	}
+	return token.NewTagToken(token.OpenToken, m.delim, []string{lang, ""}),
+		token.NewTagToken(token.CloseToken, m.delim, nil)
+}
+
+// splitsCode returns whether a match contains an odd number of backticks, so it would end
+// inside a code span that starts inside it or start inside one that ends inside it.
+func splitsCode(match string) bool {
+	return strings.Count(match, "`")%2 != 0
+}
+
+// wholeCodeSpans returns expr with a BodyExpr that only matches bodies with an even number of
+// backticks, so a closing delimiter inside a code span is skipped for a later one. If esc isn't 0,
+// the characters after escape characters outside of code spans are skipped too.
+func wholeCodeSpans(expr lexer.Expression, esc rune) lexer.Expression {
+	if expr.CloseExpr == "" || expr.BodyExpr != "" {
+		return expr
+	}
+	other, code := "[^`]", "`[^`]*`"
+	if expr.Flags&lexer.NoNewline != 0 {
+		other, code = "[^`\\n]", "`[^`\\n]*`"
+	}
+	if esc != 0 {
+		// The lexer makes . match newlines unless the expression is NoNewline
+		other = fmt.Sprintf(`%s\x{%x}]|\x{%x}.`, other[:len(other)-1], esc, esc)
+	}
+	expr.BodyExpr = "(?:" + other + "|" + code + ")*?"
+	return expr
+}
+
+// codeFirst wraps a Matcher that isn't from this package, so it doesn't split code spans either.
+type codeFirst struct {
+	lexer.Matcher
+}
+
+func (cf codeFirst) Exprs() []lexer.Expression {
+	exprs := cf.Matcher.Exprs()
+	ret := make([]lexer.Expression, len(exprs))
+	for i, expr := range exprs {
+		ret[i] = wholeCodeSpans(expr, 0)
+	}
+	return ret
+}
+
+// Alias returns the Alias of the wrapped Matcher if it is a lexer.AliasMatcher, so wrapping it doesn't change its permissions.
+func (cf codeFirst) Alias() string {
+	if am, ok := cf.Matcher.(lexer.AliasMatcher); ok {
+		return am.Alias()
+	}
+	return ""
+}
+
+func (cf codeFirst) IsValid(args *token.TokenArgs, expNum int) bool {
+	return !splitsCode(args.ById(0)) && cf.Matcher.IsValid(args, expNum)
+}
+
+// IsValidContext and BuildTokenContext pass the context on if the wrapped Matcher is a lexer.ContextMatcher.
+func (cf codeFirst) IsValidContext(ctx context.Context, args *token.TokenArgs, expNum int) bool {
+	if cm, ok := cf.Matcher.(lexer.ContextMatcher); ok {
+		return !splitsCode(args.ById(0)) && cm.IsValidContext(ctx, args, expNum)
+	}
+	return cf.IsValid(args, expNum)
+}
+
+func (cf codeFirst) BuildTokenContext(ctx context.Context, args *token.TokenArgs, expNum int) (token.Token, token.Token) {
+	if cm, ok := cf.Matcher.(lexer.ContextMatcher); ok {
+		return cm.BuildTokenContext(ctx, args, expNum)
+	}
+	return cf.BuildToken(args, expNum)
+}
+
+// escapable wraps a matcher that isn't for code, so that its closing delimiter can be escaped with esc.
+type escapable struct {
+	*matcher
+	esc rune
+}
+
+// Exprs skips escaped characters in the body, so an escaped closing delimiter is skipped for the next one.
+func (e escapable) Exprs() []lexer.Expression {
+	return []lexer.Expression{wholeCodeSpans(e.expr, e.esc)}
+}
+
+// Matchers returns the markdown matchers, in the order they should be tried. esc makes the markdown
+// delimiters, "[" or esc after it literal, like a bbcode.Parser's EscapeChar; escape characters
+// in code are literal. If esc is 0, nothing can be escaped.
+func Matchers(esc rune) []lexer.Matcher {
+	var ret []lexer.Matcher
+	if esc != 0 {
+		ret = append(ret, lexer.NewEscapeMatcher("md_escape", esc, "```", "`", "||", "~~", "__", ">", "["))
+	}
+	for _, m := range matchers {
+		if esc != 0 && !m.code {
+			ret = append(ret, escapable{m, esc})
+		} else {
+			ret = append(ret, m)
+		}
+	}
+	return ret
+}
+
+// Lexer returns a lexer.Lexer that uses the markdown matchers with the escape character esc,
+// followed by others. The other matchers are wrapped so that they don't split code spans.
+func Lexer(esc rune, others ...lexer.Matcher) (*lexer.Lexer, error) {
+	all := Matchers(esc)
+	for _, m := range others {
+		all = append(all, codeFirst{m})
+	}
+	return lexer.New(all...)
+}
+
+// Tags returns the bbcode.HtmlTags that render the tokens produced by the markdown matchers.
+// They can be merged with other tags, i.e. from a ruleset, and passed to bbcode.NewParser.
+// The inline ones are Symmetric, so the Parser also understands them when parsing on its own.
+func Tags() map[string]bbcode.HtmlTags {
+	defaults := bbcode.DefaultTags()
+
+	strike, underline, quote := defaults["s"], defaults["u"], defaults["quote"]
+	strike.Symmetric, underline.Symmetric = true, true
+	strike.Alias, underline.Alias, quote.Alias = "s", "u", "quote"
+	return map[string]bbcode.HtmlTags{
+		"```": defaults["```"],
+		"`": {
+			Options:      token.NoParseInner,
+			Tags:         []string{"code"},
+			Symmetric:    true,
+			KeepNewlines: true,
+		},
+		"||": defaults["||"],
+		"~~": strike,
+		"__": underline,
+		">":  quote,
+	}
+}
@@ -0,0 +1,94 @@
+package markdown_test
+
+import (
+	"."
+	"github.com/moechat/parser/bbcode"
+	"github.com/moechat/parser/permission"
+	"github.com/moechat/parser/ruleset"
+	"testing"
+)
+
+func TestMarkdown(t *testing.T) {
+	rs, err := ruleset.Parse([]byte(`[[tags]]
+name = "b"
+elements = [{ tag = "b" }]
+`), ruleset.TOML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tags := rs.TagTable()
+	for name, htmlTags := range markdown.Tags() {
+		tags[name] = htmlTags
+	}
+	p := bbcode.NewParser(tags)
+
+	l, err := markdown.Lexer('\\', rs.Matchers()...)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := map[string]string{
+		"`[b]x[/b]` ~~gone~~ __under__":               `<code>[b]x[/b]</code> <s>gone</s> <span class=" underline">under</span>`,
+		"~~a `b~~` c`":                                "~~a <code>b~~</code> c`",
+		"[b]bold[/b] `[b]code[/b]`":                   "<b>bold</b> <code>[b]code[/b]</code>",
+		"[b]x `[/b]` y[/b]":                           "<b>x <code>[/b]</code> y</b>",
+		"~~a `~~` b~~ c":                              "<s>a <code>~~</code> b</s> c",
+		"```go\nif ~~x~~ {}\n``` and ```\n<raw>\n```": `<pre><code class="language-go">if ~~x~~ {}</code></pre> and <pre><code>&lt;raw&gt;</code></pre>`,
+		"> quoted ||secret||\nnot quoted":             `<blockquote class="quote">quoted <span class="spoiler" role="button" tabindex="0" aria-expanded="false">secret</span></blockquote>not quoted`,
+		"a > b ~~~~ x `` y":                           "a &gt; b ~~~~ x `` y",
+		`\~~not struck\~~ \[b]plain[/b] \\~~struck~~`: `~~not struck~~ [b]plain[/b] \<s>struck</s>`,
+		`||a \|| b||`:                                 `<span class="spoiler" role="button" tabindex="0" aria-expanded="false">a || b</span>`,
+		`~~a \\~~ b~~`:                                "<s>a \\</s> b~~",
+		"~~a \\` b~~ `c~~`":                           "<s>a ` b</s> <code>c~~</code>",
+		"`code \\` stays` a\\b":                       "<code>code \\</code> stays` a\\b",
+		"\\> not quoted":                              "&gt; not quoted",
+		"`x`> y":                                      "<code>x</code>&gt; y",
+		"[b]x[/b]> y":                                 "<b>x</b>&gt; y",
+		"__a__> b":                                    `<span class=" underline">a</span>&gt; b`,
+		"~~> x~~":                                     "<s>&gt; x</s>",
+		"a\n> b":                                      "a\n<blockquote class=\"quote\">b</blockquote>",
+	}
+	for input, expected := range tests {
+		out, err := p.RenderTokens(l.Tokenize(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != expected {
+			t.Errorf("%q rendered as %q, expected %q", input, out, expected)
+		}
+	}
+
+	// Escaped closing delimiters are skipped like a bbcode.Parser skips them
+	for _, input := range []string{`||a \|| b||`, `~~a \\~~ b~~`, "~~a \\` b~~ `c~~`"} {
+		lexed, err := p.RenderTokens(l.Tokenize(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if parsed, err := p.Parse(input); err != nil || parsed != lexed {
+			t.Errorf("%q lexed as %q, but parsed as %q, %v", input, lexed, parsed, err)
+		}
+	}
+}
+
+func TestPermissions(t *testing.T) {
+	// Denying a tag denies the markdown for it in the lexer too, like in a bbcode.Parser
+	p := bbcode.NewParser(markdown.Tags())
+	l, err := markdown.Lexer('\\')
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := "~~x~~ ||y|| __z__"
+	perms := permission.Deny("s", "spoiler")
+	expected := `~~x~~ ||y|| <span class=" underline">z</span>`
+
+	out, err := p.RenderTokens(l.TokenizeWith(input, perms))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if out != expected {
+		t.Errorf("%q lexed with %+v rendered as %q, expected %q", input, perms, out, expected)
+	}
+	if out, err := p.ParseWith(input, perms); err != nil || out != expected {
+		t.Errorf("%q parsed with %+v as %q, %v", input, perms, out, err)
+	}
+}
@@ -0,0 +1,180 @@
+/*
+ * Package media matches links to media against an allowlist of providers, so they
+ * can be embedded safely.
+ *
+ * A Provider recognizes URLs with regular expressions, pulls out the media's ID and
+ * start time, and builds the URL to embed. Only URLs built by a Provider are ever
+ * embedded, so a URL that doesn't match any of them can only be linked to.
+ */
+package media
+
+import (
+	"net/url"
+	"regexp"
+	"strconv"
+)
+
+// The kinds of media
+type Kind int
+
+const (
+	Video Kind = iota
+	Audio
+)
+
+func (k Kind) String() string {
+	if k == Audio {
+		return "audio"
+	}
+	return "video"
+}
+
+// A Provider is a site whose media can be embedded.
+type Provider struct {
+	Name string
+	Kind Kind
+	// The URLs of the provider's media. Each has an "id" group, and may have a "start" group
+	// holding the start time in seconds or in the form 1h2m3s.
+	Patterns []*regexp.Regexp
+	// Whether the media is embedded in a sandboxed iframe; if not, it is a file embedded with <video> or <audio>
+	Iframe bool
+	// Returns the URL to embed, given the media's ID and start time in seconds
+	Src func(id string, start int) string
+}
+
+// An Embed is a link to media that was matched by a Provider.
+type Embed struct {
+	Provider *Provider
+	ID       string
+	Start    int    // The time to start playing at, in seconds
+	Src      string // The URL to embed
+}
+
+// Match returns the Embed for link, or nil if link isn't one of p's URLs.
+func (p *Provider) Match(link string) *Embed {
+	for _, re := range p.Patterns {
+		m := re.FindStringSubmatch(link)
+		if m == nil {
+			continue
+		}
+
+		e := &Embed{Provider: p}
+		for i, name := range re.SubexpNames() {
+			switch name {
+			case "id":
+				e.ID = m[i]
+			case "start":
+				e.Start = parseStart(m[i])
+			}
+		}
+		e.Src = p.Src(e.ID, e.Start)
+		return e
+	}
+	return nil
+}
+
+// Find returns the Embed for link from the first provider in providers that matches it and
+// for which use returns true, or nil if there is none. If use is nil, every provider is used.
+func Find(providers []*Provider, link string, use func(*Provider) bool) *Embed {
+	for _, p := range providers {
+		if use != nil && !use(p) {
+			continue
+		}
+		if e := p.Match(link); e != nil {
+			return e
+		}
+	}
+	return nil
+}
+
+var startRe = regexp.MustCompile(`^(?:([0-9]+)h)?(?:([0-9]+)m)?(?:([0-9]+)s?)?$`)
+
+// parseStart parses a start time like 90, 90s or 1m30s into seconds, returning 0 if it is invalid.
+func parseStart(start string) int {
+	m := startRe.FindStringSubmatch(start)
+	if m == nil {
+		return 0
+	}
+	seconds := 0
+	for i, unit := range []int{3600, 60, 1} {
+		n, _ := strconv.Atoi(m[i+1])
+		seconds += n * unit
+	}
+	return seconds
+}
+
+// The built-in providers
+var (
+	YouTube = &Provider{
+		Name: "youtube",
+		Kind: Video,
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`^https?://(?:www\.|m\.)?youtube\.com/watch\?(?:[^#\s]*&)?v=(?P<id>[A-Za-z0-9_-]{11})(?:[^#\s]*?&t=(?P<start>[0-9hms]+))?[^\s]*$`),
+			regexp.MustCompile(`^https?://youtu\.be/(?P<id>[A-Za-z0-9_-]{11})(?:\?(?:[^#\s]*&)?t=(?P<start>[0-9hms]+))?[^\s]*$`),
+			regexp.MustCompile(`^https?://(?:www\.)?youtube(?:-nocookie)?\.com/embed/(?P<id>[A-Za-z0-9_-]{11})(?:\?(?:[^#\s]*&)?start=(?P<start>[0-9]+))?[^\s]*$`),
+			// A bare video ID, i.e. [youtube]dQw4w9WgXcQ[/youtube]
+			regexp.MustCompile(`^(?P<id>[A-Za-z0-9_-]{11})$`),
+		},
+		Iframe: true,
+		Src: func(id string, start int) string {
+			src := "https://www.youtube-nocookie.com/embed/" + id
+			if start > 0 {
+				src += "?start=" + strconv.Itoa(start)
+			}
+			return src
+		},
+	}
+	Vimeo = &Provider{
+		Name: "vimeo",
+		Kind: Video,
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`^https?://(?:www\.)?vimeo\.com/(?P<id>[0-9]+)(?:[?#][^\s]*)?$`),
+		},
+		Iframe: true,
+		Src: func(id string, start int) string {
+			src := "https://player.vimeo.com/video/" + id
+			if start > 0 {
+				src += "#t=" + strconv.Itoa(start) + "s"
+			}
+			return src
+		},
+	}
+	SoundCloud = &Provider{
+		Name: "soundcloud",
+		Kind: Audio,
+		Patterns: []*regexp.Regexp{
+			regexp.MustCompile(`^https?://(?:www\.|m\.)?soundcloud\.com/(?P<id>[A-Za-z0-9_-]+/[A-Za-z0-9_-]+)/?(?:\?[^\s]*)?$`),
+		},
+		Iframe: true,
+		Src: func(id string, start int) string {
+			return "https://w.soundcloud.com/player/?url=" + url.QueryEscape("https://soundcloud.com/"+id)
+		},
+	}
+)
+
+// Providers is the default allowlist of providers. It can be changed before any messages are
+// parsed, or a different list can be given to each bbcode.Parser.
+var Providers = []*Provider{YouTube, Vimeo, SoundCloud}
+
+var fileExtensions = map[Kind]string{
+	Video: `mp4|webm|ogv|mov`,
+	Audio: `mp3|ogg|oga|opus|wav|m4a|flac`,
+}
+
+// FileHost returns a Provider for video or audio files served over HTTPS from host, which are
+// embedded with <video> or <audio> instead of an iframe.
+func FileHost(name, host string, kind Kind) *Provider {
+	re := regexp.MustCompile(`^https://` + regexp.QuoteMeta(host) + `/(?P<id>[A-Za-z0-9_./-]+\.(?:` + fileExtensions[kind] + `))(?:#t=(?P<start>[0-9]+))?$`)
+	return &Provider{
+		Name:     name,
+		Kind:     kind,
+		Patterns: []*regexp.Regexp{re},
+		Src: func(id string, start int) string {
+			src := "https://" + host + "/" + id
+			if start > 0 {
+				src += "#t=" + strconv.Itoa(start)
+			}
+			return src
+		},
+	}
+}
@@ -0,0 +1,45 @@
+package media_test
+
+import (
+	"."
+	"testing"
+)
+
+func TestFind(t *testing.T) {
+	files := media.FileHost("files", "files.example.com", media.Audio)
+	providers := append([]*media.Provider{files}, media.Providers...)
+
+	tests := []struct {
+		link, provider, id string
+		start              int
+		src                string
+	}{
+		{"https://www.youtube.com/watch?v=dQw4w9WgXcQ&t=1m30s", "youtube", "dQw4w9WgXcQ", 90, "https://www.youtube-nocookie.com/embed/dQw4w9WgXcQ?start=90"},
+		{"https://youtu.be/dQw4w9WgXcQ?t=42", "youtube", "dQw4w9WgXcQ", 42, "https://www.youtube-nocookie.com/embed/dQw4w9WgXcQ?start=42"},
+		{"dQw4w9WgXcQ", "youtube", "dQw4w9WgXcQ", 0, "https://www.youtube-nocookie.com/embed/dQw4w9WgXcQ"},
+		{"https://vimeo.com/76979871", "vimeo", "76979871", 0, "https://player.vimeo.com/video/76979871"},
+		{"https://soundcloud.com/moe/theme-song", "soundcloud", "moe/theme-song", 0, "https://w.soundcloud.com/player/?url=https%3A%2F%2Fsoundcloud.com%2Fmoe%2Ftheme-song"},
+		{"https://files.example.com/music/op.ogg", "files", "music/op.ogg", 0, "https://files.example.com/music/op.ogg"},
+		{"https://files.example.com/music/op.exe", "", "", 0, ""},
+		{"http://files.example.com/op.ogg", "", "", 0, ""},
+		{"https://evil.example/watch?v=dQw4w9WgXcQ", "", "", 0, ""},
+		{"javascript:alert(1)//youtu.be/dQw4w9WgXcQ", "", "", 0, ""},
+	}
+
+	for _, test := range tests {
+		e := media.Find(providers, test.link, nil)
+		if e == nil {
+			if test.provider != "" {
+				t.Errorf("%s didn't match %s", test.link, test.provider)
+			}
+			continue
+		}
+		if e.Provider.Name != test.provider || e.ID != test.id || e.Start != test.start || e.Src != test.src {
+			t.Errorf("%s matched %s with ID %q starting at %d and src %s", test.link, e.Provider.Name, e.ID, e.Start, e.Src)
+		}
+	}
+
+	if e := media.Find(providers, "https://vimeo.com/1", func(p *media.Provider) bool { return p.Kind == media.Audio }); e != nil {
+		t.Error("Find used a provider that was filtered out")
+	}
+}
@@ -0,0 +1,77 @@
+/*
+ * Package parsectx carries what is known about the message being parsed, like who wrote
+ * it and where and how it is being parsed, in a context.Context. The context given to
+ * bbcode.Parser.ParseContext or lexer.Lexer.TokenizeContext is passed to every resolver and
+ * lexer.ContextMatcher, which can read these values instead of using globals. bbcode.Parser
+ * adds its Options itself.
+ */
+package parsectx
+
+import (
+	"context"
+	"github.com/moechat/parser/permission"
+)
+
+type key int
+
+const (
+	authorKey key = iota
+	roomKey
+	permissionsKey
+	optionsKey
+)
+
+// Options are the settings of the parser parsing the message. The modes are named like
+// moeparse's flags.
+type Options struct {
+	Newlines      string // How newlines are rendered: "preserve", "br" or "p"
+	MaxBlankLines int    // If positive, the most blank lines kept in a row
+	Misnesting    string // How misnested tags are repaired: "close" or "reopen"
+	Preview       bool   // Whether the message is a preview of one still being typed
+	EscapeChar    rune   // The character that makes markup literal, or 0 if nothing can be escaped
+}
+
+// WithAuthor returns a copy of ctx holding the ID of the message's author.
+func WithAuthor(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, authorKey, id)
+}
+
+// Author returns the ID of the message's author, or "" if ctx doesn't have one.
+func Author(ctx context.Context) string {
+	id, _ := ctx.Value(authorKey).(string)
+	return id
+}
+
+// WithRoom returns a copy of ctx holding the ID of the room the message is in.
+func WithRoom(ctx context.Context, id string) context.Context {
+	return context.WithValue(ctx, roomKey, id)
+}
+
+// Room returns the ID of the room the message is in, or "" if ctx doesn't have one.
+func Room(ctx context.Context) string {
+	id, _ := ctx.Value(roomKey).(string)
+	return id
+}
+
+// WithPermissions returns a copy of ctx holding the markup the message may use.
+func WithPermissions(ctx context.Context, perms *permission.Set) context.Context {
+	return context.WithValue(ctx, permissionsKey, perms)
+}
+
+// Permissions returns the markup the message may use, or nil, which allows everything,
+// if ctx doesn't say.
+func Permissions(ctx context.Context) *permission.Set {
+	perms, _ := ctx.Value(permissionsKey).(*permission.Set)
+	return perms
+}
+
+// WithOptions returns a copy of ctx holding the settings of the parser parsing the message.
+func WithOptions(ctx context.Context, opts Options) context.Context {
+	return context.WithValue(ctx, optionsKey, opts)
+}
+
+// ParseOptions returns the settings of the parser parsing the message, or false if ctx doesn't have them.
+func ParseOptions(ctx context.Context) (Options, bool) {
+	opts, ok := ctx.Value(optionsKey).(Options)
+	return opts, ok
+}
@@ -0,0 +1,31 @@
+package parsectx_test
+
+import (
+	"."
+	"context"
+	"github.com/moechat/parser/permission"
+	"testing"
+)
+
+func TestValues(t *testing.T) {
+	ctx := context.Background()
+	if parsectx.Author(ctx) != "" || parsectx.Room(ctx) != "" || parsectx.Permissions(ctx) != nil {
+		t.Error("An empty context has values")
+	}
+
+	perms := permission.Allow("b")
+	ctx = parsectx.WithPermissions(parsectx.WithRoom(parsectx.WithAuthor(ctx, "alice"), "general"), perms)
+	if parsectx.Author(ctx) != "alice" || parsectx.Room(ctx) != "general" || parsectx.Permissions(ctx) != perms {
+		t.Errorf("Context values are %q, %q and %v", parsectx.Author(ctx), parsectx.Room(ctx), parsectx.Permissions(ctx))
+	}
+}
+
+func TestOptions(t *testing.T) {
+	if _, ok := parsectx.ParseOptions(context.Background()); ok {
+		t.Error("An empty context has options")
+	}
+	opts := parsectx.Options{Newlines: "p", Misnesting: "reopen", Preview: true, EscapeChar: '\\'}
+	if got, ok := parsectx.ParseOptions(parsectx.WithOptions(context.Background(), opts)); !ok || got != opts {
+		t.Errorf("Options are %+v, %v", got, ok)
+	}
+}
@@ -0,0 +1,71 @@
+/*
+ * Package permission decides which markup a message may use, i.e. so only moderators
+ * can change the color and size of text. A Set is passed to each parse, so the same
+ * parser can be used for everyone: bbcode.Parser.ParseWith checks the names of tags,
+ * and lexer.Lexer.TokenizeWith checks the names of matchers.
+ */
+package permission
+
+// What happens to the markup a Set denies
+type Policy int
+
+const (
+	// Denied markup is left in the message as text, i.e. [color=red]x[/color]
+	Literal Policy = iota
+	// Denied markup is removed, leaving only the text inside it, i.e. x
+	Strip
+)
+
+// A Set allows or denies tags and matchers by name. A nil Set allows everything.
+// Aliases follow the tag they are another name for, so denying [color] denies [colour] too.
+type Set struct {
+	Names   map[string]bool // Whether each name is allowed
+	Default bool            // Whether the names that aren't in Names are allowed
+	Denied  Policy
+}
+
+// Allow returns a Set that only allows names.
+func Allow(names ...string) *Set {
+	s := &Set{Names: make(map[string]bool)}
+	for _, name := range names {
+		s.Names[name] = true
+	}
+	return s
+}
+
+// Deny returns a Set that allows everything except names.
+func Deny(names ...string) *Set {
+	s := &Set{Names: make(map[string]bool), Default: true}
+	for _, name := range names {
+		s.Names[name] = false
+	}
+	return s
+}
+
+// Allows returns whether s allows the tag or matcher named name.
+func (s *Set) Allows(name string) bool {
+	if s == nil {
+		return true
+	}
+	if allowed, ok := s.Names[name]; ok {
+		return allowed
+	}
+	return s.Default
+}
+
+// AllowsAlias returns whether s allows name, which is an alias of the tag or matcher named of.
+// Unless s has a Names entry for the alias itself, it is allowed if of is.
+func (s *Set) AllowsAlias(name, of string) bool {
+	if s == nil {
+		return true
+	}
+	if _, ok := s.Names[name]; ok || of == "" {
+		return s.Allows(name)
+	}
+	return s.Allows(of)
+}
+
+// Strips returns whether s removes the denied markup instead of leaving it as text.
+func (s *Set) Strips() bool {
+	return s != nil && s.Denied == Strip
+}
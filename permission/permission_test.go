@@ -0,0 +1,43 @@
+package permission_test
+
+import (
+	"."
+	"testing"
+)
+
+func TestAllows(t *testing.T) {
+	var everything *permission.Set
+	allow := permission.Allow("b", "i")
+	deny := permission.Deny("color")
+	deny.Names["b"] = true
+
+	tests := []struct {
+		set      *permission.Set
+		name     string
+		expected bool
+	}{
+		{everything, "color", true},
+		{allow, "b", true},
+		{allow, "color", false},
+		{deny, "color", false},
+		{deny, "b", true},
+		{deny, "size", true},
+		{&permission.Set{}, "b", false},
+	}
+	for _, test := range tests {
+		if allowed := test.set.Allows(test.name); allowed != test.expected {
+			t.Errorf("%+v allows %s: %t", test.set, test.name, allowed)
+		}
+	}
+	if !everything.AllowsAlias("colour", "color") || deny.AllowsAlias("colour", "color") ||
+		!permission.Allow("color").AllowsAlias("colour", "color") || !deny.AllowsAlias("size", "") {
+		t.Errorf("Aliases don't follow the tags they are names for")
+	}
+	deny.Names["colour"] = true
+	if !deny.AllowsAlias("colour", "color") {
+		t.Errorf("An alias that is allowed by name is denied")
+	}
+	if everything.Strips() || allow.Strips() || !(&permission.Set{Denied: permission.Strip}).Strips() {
+		t.Errorf("Strips doesn't match the Sets' policies")
+	}
+}
@@ -0,0 +1,335 @@
+/*
+ * Package ruleset loads BBCode tag definitions from JSON or TOML files, so tags can be
+ * configured without writing Go. A loaded Ruleset can build a lexer.Lexer or a bbcode.Parser.
+ *
+ * A TOML ruleset looks like this (the JSON format has the same structure):
+ *
+ *	[[tags]]
+ *	name = "color"
+ *	aliases = ["colour"]
+ *
+ *	[[tags.elements]]
+ *	tag = "span"
+ *	css = { 0 = "color" }
+ *
+ *	[[tags.validators]]
+ *	arg = 0
+ *	kind = "color"
+ *
+ * Each tag has these keys:
+ *	name        The tag's name; it may only contain letters, digits and underscores
+ *	aliases     Other names for the tag
+ *	open, close Regular expressions for the lexer; they default to [name=arg] and [/name]
+ *	flags       Any of NoParseInner, BodyAsArg, NoNewline, RequireClose, PossibleSingle,
+ *	            BodyAsFirstArg and HtmlSingle
+ *	elements    The HTML elements to output, each with a tag, classes, attributes and css
+ *	validators  Checks on the tag's arguments, each with an arg and a pattern or kind
+ */
+package ruleset
+
+import (
+	"errors"
+	"fmt"
+	"github.com/moechat/parser/bbcode"
+	"github.com/moechat/parser/lexer"
+	"github.com/moechat/parser/token"
+	"io/ioutil"
+	"path/filepath"
+	"regexp"
+	"strings"
+)
+
+// The formats a ruleset can be written in
+type Format int
+
+const (
+	JSON Format = iota
+	TOML
+)
+
+// An Error is a problem in a ruleset file.
+type Error struct {
+	File string
+	Line int
+	Msg  string
+}
+
+func (e *Error) Error() string {
+	if e.File == "" {
+		return fmt.Sprintf("line %d: %s", e.Line, e.Msg)
+	}
+	return fmt.Sprintf("%s:%d: %s", e.File, e.Line, e.Msg)
+}
+
+// ErrorList holds every Error found while validating a ruleset.
+type ErrorList []*Error
+
+func (el ErrorList) Error() string {
+	msgs := make([]string, len(el))
+	for i, e := range el {
+		msgs[i] = e.Error()
+	}
+	return strings.Join(msgs, "\n")
+}
+
+// An Element is an HTML element output by a tag.
+type Element struct {
+	Tag        string
+	Classes    []string
+	Attributes map[int8]string // Attribute names, keyed by the argument that provides their value
+	CssProps   map[int8]string // CSS properties, keyed by the argument that provides their value
+}
+
+// A Validator checks a single argument of a tag.
+type Validator struct {
+	Arg     int
+	Pattern *regexp.Regexp // If set, the argument must match this
+	Kind    string         // If set, the argument must be a valid value of this kind (see validatorKinds)
+}
+
+// A Tag is a single tag defined by a ruleset.
+type Tag struct {
+	Name       string
+	Aliases    []string
+	Open       string // The lexer expression for the opening tag
+	Close      string // The lexer expression for the closing tag, if there is one
+	Flags      lexer.Flags
+	Options    int // bbcode options, as in bbcode.HtmlTags
+	Elements   []Element
+	Validators []Validator
+
+	Line int // The line the tag is defined on
+}
+
+// A Ruleset is a set of tags loaded from a file.
+type Ruleset struct {
+	Tags []*Tag
+
+	// The character that makes the tag after it literal, like bbcode.Parser's EscapeChar, in both
+	// the Parser and the Lexer. Parse sets it to \; if it is 0, nothing can be escaped.
+	EscapeChar rune
+}
+
+var validatorKinds = map[string]*regexp.Regexp{
+	"url":    regexp.MustCompile(`^(?i:(?:https?://|//|/)[^\s"'<>]*)$`),
+	"color":  regexp.MustCompile(`^(?:#[0-9a-fA-F]{3,8}|[a-zA-Z]{1,20})$`),
+	"size":   regexp.MustCompile(`^[0-9]{1,3}(?:px|em|%)?$`),
+	"number": regexp.MustCompile(`^-?[0-9]+$`),
+}
+
+var (
+	nameRe     = regexp.MustCompile(`^[A-Za-z0-9_]+$`)
+	propertyRe = regexp.MustCompile(`^[a-z][a-z-]*$`)
+)
+
+// Parse parses and validates a ruleset in the given format.
+func Parse(data []byte, format Format) (*Ruleset, error) {
+	var root *value
+	var err error
+	switch format {
+	case JSON:
+		root, err = decodeJSON(data)
+	case TOML:
+		root, err = decodeTOML(data)
+	default:
+		return nil, errors.New("ruleset: unknown format")
+	}
+	if err != nil {
+		return nil, err
+	}
+
+	v := &validator{}
+	rs := v.ruleset(root)
+	if len(v.errs) != 0 {
+		return nil, v.errs
+	}
+	return rs, nil
+}
+
+// LoadFile loads a ruleset from a file. The format is chosen using the file's
+// extension, which must be .json or .toml. Errors include the file name.
+func LoadFile(path string) (*Ruleset, error) {
+	var format Format
+	switch strings.ToLower(filepath.Ext(path)) {
+	case ".json":
+		format = JSON
+	case ".toml":
+		format = TOML
+	default:
+		return nil, errors.New("ruleset: " + path + " is not a .json or .toml file")
+	}
+
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, err
+	}
+
+	rs, err := Parse(data, format)
+	switch e := err.(type) {
+	case *Error:
+		e.File = path
+	case ErrorList:
+		for _, el := range e {
+			el.File = path
+		}
+	}
+	return rs, err
+}
+
+// HtmlTags converts t into the form used by the bbcode package.
+func (t *Tag) HtmlTags() bbcode.HtmlTags {
+	ht := bbcode.HtmlTags{Options: t.Options}
+	if t.Flags&lexer.NoParseInner != 0 {
+		ht.Options |= token.NoParseInner
+	}
+	if t.Flags&lexer.BodyAsArg != 0 {
+		ht.Options |= token.TokenBodyAsArg
+	}
+
+	for _, el := range t.Elements {
+		ht.Tags = append(ht.Tags, el.Tag)
+		ht.Classes = append(ht.Classes, el.Classes)
+		ht.Attributes = append(ht.Attributes, el.Attributes)
+		ht.CssProps = append(ht.CssProps, el.CssProps)
+	}
+
+	if len(t.Validators) != 0 {
+		ht.ArgValidFunc = t.validArgs
+	}
+	return ht
+}
+
+func (t *Tag) validArgs(args []string) bool {
+	for _, v := range t.Validators {
+		arg := ""
+		if v.Arg < len(args) {
+			arg = args[v.Arg]
+		}
+		if arg == "" {
+			continue
+		}
+		if v.Pattern != nil && !v.Pattern.MatchString(arg) {
+			return false
+		}
+		if v.Kind != "" && !validatorKinds[v.Kind].MatchString(arg) {
+			return false
+		}
+	}
+	return true
+}
+
+// TagTable returns the tags in rs in the form used by bbcode.NewParser, keyed by their names and aliases.
+func (rs *Ruleset) TagTable() map[string]bbcode.HtmlTags {
+	tags := make(map[string]bbcode.HtmlTags)
+	for _, t := range rs.Tags {
+		ht := t.HtmlTags()
+		tags[t.Name] = ht
+		for _, alias := range t.Aliases {
+			aliasTags := ht
+			aliasTags.Alias = t.Name
+			tags[alias] = aliasTags
+		}
+	}
+	return tags
+}
+
+// Parser returns a bbcode.Parser that recognizes the tags in rs and their aliases.
+func (rs *Ruleset) Parser() *bbcode.Parser {
+	p := bbcode.NewParser(rs.TagTable())
+	p.EscapeChar = rs.EscapeChar
+	return p
+}
+
+// Matchers returns a lexer.Matcher for every tag in rs. The matchers produce
+// token.TagTokens, which can be rendered with the bbcode.Parser returned by Parser.
+func (rs *Ruleset) Matchers() []lexer.Matcher {
+	matchers := make([]lexer.Matcher, len(rs.Tags))
+	for i, t := range rs.Tags {
+		matchers[i] = &tagMatcher{t, regexp.MustCompile(t.Open).NumSubexp(), rs.EscapeChar}
+	}
+	return matchers
+}
+
+// Lexer returns a lexer.Lexer built from the matchers returned by Matchers, which makes
+// tags escaped with rs.EscapeChar literal.
+func (rs *Ruleset) Lexer() (*lexer.Lexer, error) {
+	matchers := rs.Matchers()
+	if rs.EscapeChar != 0 {
+		matchers = append([]lexer.Matcher{lexer.NewEscapeMatcher("bb_escape", rs.EscapeChar, "[")}, matchers...)
+	}
+	return lexer.New(matchers...)
+}
+
+// tagMatcher is the lexer.Matcher for a Tag.
+type tagMatcher struct {
+	tag      *Tag
+	openArgs int  // The number of groups in the tag's Open expression
+	esc      rune // The Ruleset's EscapeChar
+}
+
+func (tm *tagMatcher) Name() string {
+	return tm.tag.Name
+}
+
+func (tm *tagMatcher) Exprs() []lexer.Expression {
+	t := tm.tag
+	if t.Close == "" || t.Flags&lexer.BodyAsArg == 0 {
+		return []lexer.Expression{{Expr: t.Open, CloseExpr: t.Close, Flags: t.Flags}}
+	}
+
+	// The lexer doesn't capture the bodies of BodyAsArg expressions, so the body and the
+	// closing tag are matched as part of the opening one instead
+	body, close := "((?s:.*?))", "(?:"+t.Close+")"
+	if t.Flags&lexer.NoNewline != 0 {
+		body = "(.*?)"
+	}
+	if t.Flags&lexer.RequireClose == 0 {
+		close = "(?:" + t.Close + "|$)"
+	}
+	return []lexer.Expression{{Expr: "(?:" + t.Open + ")" + body + close}}
+}
+
+// args converts the lexer's arguments into the form used by bbcode.HtmlTags.
+func (tm *tagMatcher) args(args *token.TokenArgs) []string {
+	ret := make([]string, 2)
+	n := 0
+	for i := 1; i < args.Size(); i++ {
+		if i == tm.openArgs+1 && tm.tag.Close != "" && tm.tag.Flags&lexer.BodyAsArg == 0 {
+			// The body the lexer captured, which is rendered from the tokens between the open and close ones
+			continue
+		}
+		if n < len(ret) {
+			ret[n] = args.ById(i)
+		} else {
+			ret = append(ret, args.ById(i))
+		}
+		n++
+	}
+	if tm.tag.Options&token.AllowTokenBodyAsFirstArg != 0 && ret[0] == "" {
+		ret[0] = ret[1]
+	}
+	return ret
+}
+
+func (tm *tagMatcher) IsValid(args *token.TokenArgs, expNum int) bool {
+	return !tm.closeEscaped(args) && tm.tag.validArgs(tm.args(args))
+}
+
+// closeEscaped returns whether the closing tag of a match is escaped, so it can't close the tag.
+// Like in the bbcode package, the bodies of tags that aren't parsed can't have escapes.
+func (tm *tagMatcher) closeEscaped(args *token.TokenArgs) bool {
+	if tm.tag.Close == "" || tm.tag.Flags&lexer.NoParseInner != 0 {
+		return false
+	}
+	// A match that ends with its body was closed by the end of the input
+	body := args.ById(tm.openArgs + 1)
+	return !strings.HasSuffix(args.ById(0), body) && lexer.Escaped(body, tm.esc)
+}
+
+func (tm *tagMatcher) BuildToken(args *token.TokenArgs, expNum int) (token.Token, token.Token) {
+	if tm.tag.Close == "" || tm.tag.Flags&lexer.BodyAsArg != 0 {
+		return token.NewTagToken(token.SingleToken, tm.tag.Name, tm.args(args)), nil
+	}
+	return token.NewTagToken(token.OpenToken, tm.tag.Name, tm.args(args)),
+		token.NewTagToken(token.CloseToken, tm.tag.Name, nil)
+}
@@ -0,0 +1,206 @@
+package ruleset_test
+
+import (
+	"."
+	"strings"
+	"testing"
+)
+
+const tomlRuleset = `# Tags for the test room
+[[tags]]
+name = "b"
+aliases = ["bold"]
+elements = [{ tag = "b" }]
+
+[[tags]]
+name = "color"
+[[tags.elements]]
+tag = "span"
+classes = ["colored"]
+css = { 0 = "color" }
+[[tags.validators]]
+arg = 0
+kind = "color"
+
+[[tags]]
+name = "nope"
+flags = ["NoParseInner"]
+`
+
+const jsonRuleset = `{
+	"tags": [
+		{"name": "b", "aliases": ["bold"], "elements": [{"tag": "b"}]},
+		{
+			"name": "color",
+			"elements": [{"tag": "span", "classes": ["colored"], "css": {"0": "color"}}],
+			"validators": [{"arg": 0, "kind": "color"}]
+		},
+		{"name": "nope", "flags": ["NoParseInner"]}
+	]
+}`
+
+func TestLoad(t *testing.T) {
+	input := `[bold]hi[/bold] [color=red]red[/color] [color=red;x:y]bad[/color] [nope][b]x[/b][/nope]`
+
+	for format, data := range map[ruleset.Format]string{ruleset.TOML: tomlRuleset, ruleset.JSON: jsonRuleset} {
+		rs, err := ruleset.Parse([]byte(data), format)
+		if err != nil {
+			t.Fatalf("Format %d failed to load: %s", format, err)
+		}
+
+		out, err := rs.Parser().Parse(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		expected := `<b>hi</b> <span class=" colored" style="color: red;">red</span> [color=red;x:y]bad[/color] [b]x[/b]`
+		if out != expected {
+			t.Errorf("Format %d: bbcode output is %q", format, out)
+		}
+
+		l, err := rs.Lexer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		out, err = rs.Parser().RenderTokens(l.Tokenize(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		if out != expected {
+			t.Errorf("Format %d: lexer output is %q", format, out)
+		}
+	}
+}
+
+func TestPatterns(t *testing.T) {
+	// Validator patterns may match empty text, unlike open and close expressions
+	rs, err := ruleset.Parse([]byte(`{"tags": [{"name": "tag", "elements": [{"tag": "span", "classes": ["tag"]}],
+		"validators": [{"arg": 0, "pattern": "^[a-z]*$"}]}]}`), ruleset.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	input := "[tag=abc]x[/tag] [tag]y[/tag] [tag=A1]z[/tag]"
+	expected := `<span class=" tag">x</span> <span class=" tag">y</span> [tag=A1]z[/tag]`
+	if out, err := rs.Parser().Parse(input); err != nil || out != expected {
+		t.Errorf("%q parsed as %q, %v", input, out, err)
+	}
+}
+
+func TestErrors(t *testing.T) {
+	tests := []struct {
+		format ruleset.Format
+		data   string
+		errs   []string
+	}{
+		{ruleset.TOML, "[[tags]]\nname = \"b\"\nflags = [\"Bogus\"]\n\n[[tags]]\nname = \"b\"\n", []string{
+			`line 3: unknown flag "Bogus"`,
+			`line 5: the name "b" is already used on line 1`,
+		}},
+		{ruleset.TOML, "[[tags]]\nname = \"x\"\n[[tags.elements]]\ntag = \"a\"\nattributes = { 0 = \"onclick\" }\n", []string{
+			`line 5: "onclick" is not an allowed attribute`,
+		}},
+		{ruleset.JSON, "{\"tags\": [{\"name\": \"x\", \"elements\": [\n{\"tag\": \"iframe\"},\n{\"tag\": \"form\"},\n" +
+			"{\"tag\": \"img\", \"attributes\": {\"0\": \"srcdoc\"}}]}]}", []string{
+			`line 2: "iframe" is not an allowed element`,
+			`line 3: "form" is not an allowed element`,
+			`line 4: "srcdoc" is not an allowed attribute`,
+		}},
+		{ruleset.TOML, "[[tags]]\nname = \"x\"\nopen = \"[\"\n", []string{
+			"line 3: open is not a valid regular expression",
+		}},
+		{ruleset.JSON, `{"tags": [{"name": "e", "open": ":?", "elements": [{"tag": "b"}]}]}`, []string{
+			"line 1: open matches empty text",
+		}},
+		{ruleset.TOML, "[[tags]]\nname = \"x\n", []string{
+			"line 2: unterminated string",
+		}},
+		{ruleset.JSON, "{\n\"tags\": [\n{\"name\": \"x\",\n\"colour\": 1}\n]}", []string{
+			`line 4: unknown key "colour" in tag`,
+		}},
+		{ruleset.JSON, "{\n\"tags\": [\n{\"name\": \"x\",,}]}", []string{
+			"line 3: invalid character ','",
+		}},
+	}
+
+	for _, test := range tests {
+		_, err := ruleset.Parse([]byte(test.data), test.format)
+		if err == nil {
+			t.Errorf("Expected errors %q, got nothing", test.errs)
+			continue
+		}
+		msgs := strings.Split(err.Error(), "\n")
+		if len(msgs) != len(test.errs) {
+			t.Errorf("Expected errors %q, got %q", test.errs, msgs)
+			continue
+		}
+		for i, msg := range msgs {
+			if !strings.HasPrefix(msg, test.errs[i]) {
+				t.Errorf("Expected error %q, got %q", test.errs[i], msg)
+			}
+		}
+	}
+}
+
+func TestBodyAsArg(t *testing.T) {
+	rs, err := ruleset.Parse([]byte(`{"tags": [
+		{"name": "b", "elements": [{"tag": "b"}]},
+		{
+			"name": "img",
+			"flags": ["BodyAsArg", "BodyAsFirstArg", "HtmlSingle"],
+			"elements": [{"tag": "img", "attributes": {"0": "src", "1": "title"}}],
+			"validators": [{"arg": 0, "kind": "url"}]
+		}
+	]}`), ruleset.JSON)
+	if err != nil {
+		t.Fatal(err)
+	}
+	l, err := rs.Lexer()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	input := "[b]x[img]/a.png[/img][/b] [img=/b.png]y[/img]"
+	out, err := rs.Parser().RenderTokens(l.Tokenize(input))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := `<b>x<img src="/a.png" title="/a.png"></b> <img src="/b.png" title="y">`; out != expected {
+		t.Errorf("%q tokenized as %q, expected %q", input, out, expected)
+	}
+}
+
+func TestEscapes(t *testing.T) {
+	rs, err := ruleset.Parse([]byte(tomlRuleset), ruleset.TOML)
+	if err != nil {
+		t.Fatal(err)
+	}
+	render := func(input string) (string, string) {
+		out, err := rs.Parser().Parse(input)
+		if err != nil {
+			t.Fatal(err)
+		}
+		l, err := rs.Lexer()
+		if err != nil {
+			t.Fatal(err)
+		}
+		lexed, err := rs.Parser().RenderTokens(l.Tokenize(input))
+		if err != nil {
+			t.Fatal(err)
+		}
+		return out, lexed
+	}
+
+	input := `\[b]x[/b] \\[bold]y[/bold] [nope]\[/nope]`
+	expected := `[b]x[/b] \<b>y</b> \`
+	if out, lexed := render(input); out != expected || lexed != expected {
+		t.Errorf("%q rendered as %q by the parser and %q by the lexer, expected %q", input, out, lexed, expected)
+	}
+	// The lexer only tries the first closing tag
+	if _, lexed := render(`[b]x\[/b]`); lexed != "[b]x[/b]" {
+		t.Errorf("An escaped closing tag closed a tag in the lexer: %q", lexed)
+	}
+
+	rs.EscapeChar = 0
+	if out, lexed := render(`\[b]x[/b]`); out != `\<b>x</b>` || lexed != out {
+		t.Errorf("Without escapes, the parser gave %q and the lexer %q", out, lexed)
+	}
+}
@@ -0,0 +1,379 @@
+package ruleset
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"unicode/utf8"
+)
+
+// tomlParser decodes the subset of TOML used by ruleset files: tables, arrays of tables,
+// (dotted) keys, strings, integers, booleans, arrays and inline tables.
+// Dates, floats and multi-line strings are not supported.
+type tomlParser struct {
+	data []byte
+	pos  int
+	line int
+
+	defined map[*value]bool // Tables that have been opened with a [header]
+}
+
+// decodeTOML decodes data into a value tree.
+func decodeTOML(data []byte) (*value, error) {
+	p := &tomlParser{data: data, line: 1, defined: make(map[*value]bool)}
+	root := newTable(1)
+	current := root
+
+	for {
+		p.skipBlank()
+		if p.eof() {
+			return root, nil
+		}
+
+		var err error
+		if p.peek() == '[' {
+			current, err = p.parseHeader(root)
+		} else {
+			err = p.parseKeyValue(current)
+		}
+		if err == nil {
+			err = p.endOfLine()
+		}
+		if err != nil {
+			return nil, err
+		}
+	}
+}
+
+func (p *tomlParser) errorf(format string, args ...interface{}) error {
+	return &Error{Line: p.line, Msg: fmt.Sprintf(format, args...)}
+}
+
+func (p *tomlParser) eof() bool {
+	return p.pos >= len(p.data)
+}
+
+func (p *tomlParser) peek() byte {
+	if p.eof() {
+		return 0
+	}
+	return p.data[p.pos]
+}
+
+func (p *tomlParser) next() byte {
+	c := p.peek()
+	p.pos++
+	if c == '\n' {
+		p.line++
+	}
+	return c
+}
+
+// skipSpace skips spaces and tabs.
+func (p *tomlParser) skipSpace() {
+	for c := p.peek(); c == ' ' || c == '\t'; c = p.peek() {
+		p.next()
+	}
+}
+
+// skipBlank skips whitespace, newlines and comments.
+func (p *tomlParser) skipBlank() {
+	for !p.eof() {
+		switch p.peek() {
+		case ' ', '\t', '\r', '\n':
+			p.next()
+		case '#':
+			for !p.eof() && p.peek() != '\n' {
+				p.next()
+			}
+		default:
+			return
+		}
+	}
+}
+
+// endOfLine consumes the rest of the line, which may only contain a comment.
+func (p *tomlParser) endOfLine() error {
+	p.skipSpace()
+	if p.peek() == '#' {
+		for !p.eof() && p.peek() != '\n' {
+			p.next()
+		}
+	}
+	if p.peek() == '\r' {
+		p.next()
+	}
+	if !p.eof() && p.peek() != '\n' {
+		return p.errorf("unexpected %q after value", p.peek())
+	}
+	p.next()
+	return nil
+}
+
+func isBareKeyChar(c byte) bool {
+	return c >= 'a' && c <= 'z' || c >= 'A' && c <= 'Z' || c >= '0' && c <= '9' || c == '_' || c == '-'
+}
+
+// parseKey parses a possibly dotted key, returning its parts.
+func (p *tomlParser) parseKey() ([]string, error) {
+	var parts []string
+	for {
+		p.skipSpace()
+		var part string
+		switch c := p.peek(); {
+		case c == '"' || c == '\'':
+			s, err := p.parseString()
+			if err != nil {
+				return nil, err
+			}
+			part = s
+		case isBareKeyChar(c):
+			start := p.pos
+			for isBareKeyChar(p.peek()) {
+				p.next()
+			}
+			part = string(p.data[start:p.pos])
+		default:
+			return nil, p.errorf("expected a key")
+		}
+		parts = append(parts, part)
+
+		p.skipSpace()
+		if p.peek() != '.' {
+			return parts, nil
+		}
+		p.next()
+	}
+}
+
+// walk follows path from table, creating tables as needed. Arrays of tables resolve to their last element.
+func (p *tomlParser) walk(table *value, path []string) (*value, error) {
+	for _, key := range path {
+		child, ok := table.fields[key]
+		if !ok {
+			child = newTable(p.line)
+			table.set(key, child)
+		}
+		if child.kind == arrayValue && len(child.array) > 0 && child.array[len(child.array)-1].kind == tableValue {
+			child = child.array[len(child.array)-1]
+		}
+		if child.kind != tableValue {
+			return nil, p.errorf("key %q is already defined as %s", key, kindNames[child.kind])
+		}
+		table = child
+	}
+	return table, nil
+}
+
+// parseHeader parses a [table] or [[array.of.tables]] header, returning the table it opens.
+func (p *tomlParser) parseHeader(root *value) (*value, error) {
+	p.next()
+	isArray := p.peek() == '['
+	if isArray {
+		p.next()
+	}
+
+	path, err := p.parseKey()
+	if err != nil {
+		return nil, err
+	}
+	for i := 0; i < 1 || isArray && i < 2; i++ {
+		if p.next() != ']' {
+			return nil, p.errorf("expected ] to end the table header")
+		}
+	}
+
+	parent, err := p.walk(root, path[:len(path)-1])
+	if err != nil {
+		return nil, err
+	}
+	key := path[len(path)-1]
+	existing, ok := parent.fields[key]
+
+	if isArray {
+		if !ok {
+			existing = &value{kind: arrayValue, line: p.line}
+			parent.set(key, existing)
+		} else if existing.kind != arrayValue {
+			return nil, p.errorf("key %q is already defined as %s", key, kindNames[existing.kind])
+		}
+		table := newTable(p.line)
+		existing.array = append(existing.array, table)
+		p.defined[table] = true
+		return table, nil
+	}
+
+	table, err := p.walk(parent, []string{key})
+	if err != nil {
+		return nil, err
+	}
+	if p.defined[table] {
+		return nil, p.errorf("table %q is defined more than once", strings.Join(path, "."))
+	}
+	p.defined[table] = true
+	return table, nil
+}
+
+// parseKeyValue parses a key = value pair into table.
+func (p *tomlParser) parseKeyValue(table *value) error {
+	line := p.line
+	path, err := p.parseKey()
+	if err != nil {
+		return err
+	}
+	if p.next() != '=' {
+		return p.errorf("expected = after key")
+	}
+	p.skipSpace()
+
+	v, err := p.parseValue()
+	if err != nil {
+		return err
+	}
+
+	table, err = p.walk(table, path[:len(path)-1])
+	if err != nil {
+		return err
+	}
+	key := path[len(path)-1]
+	if _, ok := table.fields[key]; ok {
+		return &Error{Line: line, Msg: fmt.Sprintf("duplicate key %q", key)}
+	}
+	table.set(key, v)
+	return nil
+}
+
+func (p *tomlParser) parseValue() (*value, error) {
+	line := p.line
+	switch c := p.peek(); {
+	case c == '"' || c == '\'':
+		s, err := p.parseString()
+		if err != nil {
+			return nil, err
+		}
+		return &value{kind: stringValue, line: line, str: s}, nil
+
+	case c == '[':
+		p.next()
+		v := &value{kind: arrayValue, line: line}
+		for {
+			p.skipBlank()
+			if p.peek() == ']' {
+				p.next()
+				return v, nil
+			}
+			elem, err := p.parseValue()
+			if err != nil {
+				return nil, err
+			}
+			v.array = append(v.array, elem)
+
+			p.skipBlank()
+			if p.peek() == ',' {
+				p.next()
+			} else if p.peek() != ']' {
+				return nil, p.errorf("expected , or ] in array")
+			}
+		}
+
+	case c == '{':
+		p.next()
+		v := newTable(line)
+		p.skipSpace()
+		if p.peek() == '}' {
+			p.next()
+			return v, nil
+		}
+		for {
+			if err := p.parseKeyValue(v); err != nil {
+				return nil, err
+			}
+			p.skipSpace()
+			switch p.next() {
+			case '}':
+				return v, nil
+			case ',':
+				p.skipSpace()
+			default:
+				return nil, p.errorf("expected , or } in inline table")
+			}
+		}
+
+	case c == 't' || c == 'f':
+		start := p.pos
+		for isBareKeyChar(p.peek()) {
+			p.next()
+		}
+		switch string(p.data[start:p.pos]) {
+		case "true":
+			return &value{kind: boolValue, line: line, b: true}, nil
+		case "false":
+			return &value{kind: boolValue, line: line, b: false}, nil
+		}
+		return nil, p.errorf("invalid value %q", p.data[start:p.pos])
+
+	case c == '+' || c == '-' || c >= '0' && c <= '9':
+		start := p.pos
+		p.next()
+		for isBareKeyChar(p.peek()) || p.peek() == '.' {
+			p.next()
+		}
+		text := strings.Replace(string(p.data[start:p.pos]), "_", "", -1)
+		n, err := strconv.ParseInt(text, 10, 64)
+		if err != nil {
+			return nil, p.errorf("%s is not an integer", p.data[start:p.pos])
+		}
+		return &value{kind: intValue, line: line, num: n}, nil
+	}
+	return nil, p.errorf("expected a value")
+}
+
+// parseString parses a basic ("...") or literal ('...') single-line string.
+func (p *tomlParser) parseString() (string, error) {
+	quote := p.next()
+	var buf []byte
+	for {
+		if p.eof() || p.peek() == '\n' {
+			return "", p.errorf("unterminated string")
+		}
+		c := p.next()
+		switch {
+		case c == quote:
+			return string(buf), nil
+		case c == '\\' && quote == '"':
+			esc := p.next()
+			switch esc {
+			case 'b':
+				buf = append(buf, '\b')
+			case 't':
+				buf = append(buf, '\t')
+			case 'n':
+				buf = append(buf, '\n')
+			case 'f':
+				buf = append(buf, '\f')
+			case 'r':
+				buf = append(buf, '\r')
+			case '"', '\\':
+				buf = append(buf, esc)
+			case 'u', 'U':
+				size := 4
+				if esc == 'U' {
+					size = 8
+				}
+				if p.pos+size > len(p.data) {
+					return "", p.errorf("invalid unicode escape")
+				}
+				r, err := strconv.ParseUint(string(p.data[p.pos:p.pos+size]), 16, 32)
+				if err != nil || !utf8.ValidRune(rune(r)) {
+					return "", p.errorf("invalid unicode escape")
+				}
+				p.pos += size
+				buf = append(buf, string(rune(r))...)
+			default:
+				return "", p.errorf("invalid escape sequence \\%c", esc)
+			}
+		default:
+			buf = append(buf, c)
+		}
+	}
+}
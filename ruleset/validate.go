@@ -0,0 +1,325 @@
+package ruleset
+
+import (
+	"fmt"
+	"github.com/moechat/parser/htmlcheck"
+	"github.com/moechat/parser/lexer"
+	"github.com/moechat/parser/token"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+var lexerFlags = map[string]lexer.Flags{
+	"NoParseInner": lexer.NoParseInner,
+	"BodyAsArg":    lexer.BodyAsArg,
+	"NoNewline":    lexer.NoNewline,
+	"RequireClose": lexer.RequireClose,
+}
+
+var bbcodeOptions = map[string]int{
+	"PossibleSingle": token.PossibleSingle,
+	"BodyAsFirstArg": token.AllowTokenBodyAsFirstArg,
+	"HtmlSingle":     token.HtmlSingle,
+}
+
+// allowedElements are the elements a ruleset may output, mapped to the attributes they may have.
+// They are the ones htmlcheck allows, except for embeds, which only the media tags output.
+var allowedElements = func() map[string][]string {
+	elements := htmlcheck.DefaultPolicy().Elements
+	for _, embed := range []string{"iframe", "video", "audio"} {
+		delete(elements, embed)
+	}
+	return elements
+}()
+
+// validator converts a value tree into a Ruleset, collecting every error it finds.
+type validator struct {
+	errs ErrorList
+}
+
+func (v *validator) errorf(line int, format string, args ...interface{}) {
+	v.errs = append(v.errs, &Error{Line: line, Msg: fmt.Sprintf(format, args...)})
+}
+
+// expect reports an error if val isn't of the given kind.
+func (v *validator) expect(val *value, kind valueKind, what string) bool {
+	if val.kind != kind {
+		v.errorf(val.line, "%s must be %s, not %s", what, kindNames[kind], kindNames[val.kind])
+		return false
+	}
+	return true
+}
+
+// fields checks that table only has the given keys.
+func (v *validator) fields(table *value, what string, keys ...string) {
+	allowed := make(map[string]bool)
+	for _, k := range keys {
+		allowed[k] = true
+	}
+	for _, k := range table.keys {
+		if !allowed[k] {
+			v.errorf(table.fields[k].line, "unknown key %q in %s", k, what)
+		}
+	}
+}
+
+func (v *validator) strings(val *value, what string) []string {
+	if !v.expect(val, arrayValue, what) {
+		return nil
+	}
+	ret := make([]string, 0, len(val.array))
+	for _, elem := range val.array {
+		if v.expect(elem, stringValue, what+" entries") {
+			ret = append(ret, elem.str)
+		}
+	}
+	return ret
+}
+
+// tables returns the tables in val, which must be an array of tables.
+func (v *validator) tables(val *value, what string) []*value {
+	if !v.expect(val, arrayValue, what) {
+		return nil
+	}
+	ret := make([]*value, 0, len(val.array))
+	for _, elem := range val.array {
+		if v.expect(elem, tableValue, what+" entries") {
+			ret = append(ret, elem)
+		}
+	}
+	return ret
+}
+
+func (v *validator) ruleset(root *value) *Ruleset {
+	rs := &Ruleset{EscapeChar: '\\'}
+	if !v.expect(root, tableValue, "the ruleset") {
+		return rs
+	}
+	v.fields(root, "the ruleset", "tags")
+
+	tags, ok := root.fields["tags"]
+	if !ok {
+		v.errorf(root.line, "the ruleset has no tags")
+		return rs
+	}
+
+	names := make(map[string]int)
+	for _, t := range v.tables(tags, "tags") {
+		tag := v.tag(t)
+		if tag == nil {
+			continue
+		}
+		for _, name := range append([]string{tag.Name}, tag.Aliases...) {
+			if line, ok := names[name]; ok {
+				v.errorf(t.line, "the name %q is already used on line %d", name, line)
+			}
+			names[name] = t.line
+		}
+		rs.Tags = append(rs.Tags, tag)
+	}
+	return rs
+}
+
+func (v *validator) tag(t *value) *Tag {
+	v.fields(t, "tag", "name", "aliases", "open", "close", "flags", "elements", "validators")
+	tag := &Tag{Line: t.line}
+
+	if name, ok := t.fields["name"]; !ok {
+		v.errorf(t.line, "tag has no name")
+		return nil
+	} else if v.expect(name, stringValue, "name") {
+		tag.Name = name.str
+		if !nameRe.MatchString(tag.Name) {
+			v.errorf(name.line, "tag name %q may only contain letters, digits and underscores", tag.Name)
+		}
+	}
+
+	if aliases, ok := t.fields["aliases"]; ok {
+		tag.Aliases = v.strings(aliases, "aliases")
+		for _, alias := range tag.Aliases {
+			if !nameRe.MatchString(alias) {
+				v.errorf(aliases.line, "alias %q may only contain letters, digits and underscores", alias)
+			}
+		}
+	}
+
+	if flags, ok := t.fields["flags"]; ok {
+		for _, flag := range v.strings(flags, "flags") {
+			if f, ok := lexerFlags[flag]; ok {
+				tag.Flags |= f
+			} else if o, ok := bbcodeOptions[flag]; ok {
+				tag.Options |= o
+			} else {
+				v.errorf(flags.line, "unknown flag %q", flag)
+			}
+		}
+	}
+
+	names := make([]string, 0, len(tag.Aliases)+1)
+	for _, name := range append([]string{tag.Name}, tag.Aliases...) {
+		names = append(names, regexp.QuoteMeta(name))
+	}
+	nameExpr := "(?:" + strings.Join(names, "|") + ")"
+	tag.Open = `\[` + nameExpr + `(?:=([^\]]*))?\]`
+	tag.Close = `\[/` + nameExpr + `\]`
+
+	if open, ok := t.fields["open"]; ok {
+		if open.kind == stringValue && open.str == "" {
+			v.errorf(open.line, "open may not be empty")
+		}
+		tag.Open = v.delimiter(open, "open")
+		tag.Close = ""
+	}
+	if close, ok := t.fields["close"]; ok {
+		tag.Close = v.delimiter(close, "close")
+	}
+
+	if elements, ok := t.fields["elements"]; ok {
+		for _, el := range v.tables(elements, "elements") {
+			tag.Elements = append(tag.Elements, v.element(el))
+		}
+	}
+
+	if validators, ok := t.fields["validators"]; ok {
+		for _, val := range v.tables(validators, "validators") {
+			tag.Validators = append(tag.Validators, v.argValidator(val))
+		}
+	}
+
+	return tag
+}
+
+func (v *validator) regexp(val *value, what string) string {
+	if !v.expect(val, stringValue, what) {
+		return ""
+	}
+	re, err := regexp.Compile(val.str)
+	if err != nil {
+		v.errorf(val.line, "%s is not a valid regular expression: %s", what, err)
+		return ""
+	}
+	for _, name := range re.SubexpNames() {
+		if strings.HasPrefix(name, "_") {
+			v.errorf(val.line, "capture group names starting with _ are reserved, %s uses %s", what, name)
+		}
+	}
+	return val.str
+}
+
+// delimiter checks that val is a regular expression for an open or close expression, which may not
+// match empty text, since the lexer would find it everywhere.
+func (v *validator) delimiter(val *value, what string) string {
+	expr := v.regexp(val, what)
+	if expr != "" && regexp.MustCompile(expr).MatchString("") {
+		v.errorf(val.line, "%s matches empty text", what)
+	}
+	return expr
+}
+
+func (v *validator) element(el *value) Element {
+	v.fields(el, "element", "tag", "classes", "attributes", "css")
+	ret := Element{}
+
+	if tag, ok := el.fields["tag"]; !ok {
+		v.errorf(el.line, "element has no tag")
+	} else if v.expect(tag, stringValue, "tag") {
+		ret.Tag = tag.str
+		if _, ok := allowedElements[ret.Tag]; !ok {
+			v.errorf(tag.line, "%q is not an allowed element", ret.Tag)
+		}
+	}
+
+	if classes, ok := el.fields["classes"]; ok {
+		ret.Classes = v.strings(classes, "classes")
+		for _, class := range ret.Classes {
+			if !nameRe.MatchString(strings.Replace(class, "-", "_", -1)) {
+				v.errorf(classes.line, "%q is not a valid class name", class)
+			}
+		}
+	}
+
+	if attrs, ok := el.fields["attributes"]; ok {
+		ret.Attributes = v.argMap(attrs, "attributes", func(line int, attr string) {
+			// Styles are only set using css, which escapes them
+			if allowed, ok := allowedElements[ret.Tag]; ok && (!contains(allowed, attr) || attr == "style") {
+				v.errorf(line, "%q is not an allowed attribute", attr)
+			}
+		})
+	}
+
+	if css, ok := el.fields["css"]; ok {
+		ret.CssProps = v.argMap(css, "css", func(line int, prop string) {
+			if !propertyRe.MatchString(prop) {
+				v.errorf(line, "%q is not a valid CSS property", prop)
+			}
+		})
+	}
+
+	return ret
+}
+
+// argMap converts a table of argument numbers to names, checking each name with check.
+func (v *validator) argMap(val *value, what string, check func(line int, name string)) map[int8]string {
+	if !v.expect(val, tableValue, what) {
+		return nil
+	}
+	ret := make(map[int8]string)
+	keys := append([]string{}, val.keys...)
+	sort.Strings(keys)
+	for _, k := range keys {
+		elem := val.fields[k]
+		arg, err := strconv.ParseInt(k, 10, 8)
+		if err != nil || arg < 0 {
+			v.errorf(elem.line, "%s keys must be argument numbers from 0 to 127, not %q", what, k)
+			continue
+		}
+		if v.expect(elem, stringValue, what+" values") {
+			check(elem.line, elem.str)
+			ret[int8(arg)] = elem.str
+		}
+	}
+	return ret
+}
+
+func (v *validator) argValidator(val *value) Validator {
+	v.fields(val, "validator", "arg", "pattern", "kind")
+	ret := Validator{}
+
+	if arg, ok := val.fields["arg"]; !ok {
+		v.errorf(val.line, "validator has no arg")
+	} else if v.expect(arg, intValue, "arg") {
+		if arg.num < 0 || arg.num > 127 {
+			v.errorf(arg.line, "arg must be from 0 to 127")
+		}
+		ret.Arg = int(arg.num)
+	}
+
+	if pattern, ok := val.fields["pattern"]; ok {
+		if expr := v.regexp(pattern, "pattern"); expr != "" {
+			ret.Pattern = regexp.MustCompile(expr)
+		}
+	}
+
+	if kind, ok := val.fields["kind"]; ok && v.expect(kind, stringValue, "kind") {
+		if _, known := validatorKinds[kind.str]; !known {
+			v.errorf(kind.line, "unknown validator kind %q", kind.str)
+		}
+		ret.Kind = kind.str
+	}
+
+	if ret.Pattern == nil && ret.Kind == "" {
+		v.errorf(val.line, "validator needs a pattern or a kind")
+	}
+	return ret
+}
+
+func contains(list []string, s string) bool {
+	for _, item := range list {
+		if item == s {
+			return true
+		}
+	}
+	return false
+}
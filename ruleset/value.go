@@ -0,0 +1,156 @@
+package ruleset
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"strconv"
+)
+
+type valueKind int
+
+const (
+	stringValue valueKind = iota
+	intValue
+	boolValue
+	arrayValue
+	tableValue
+)
+
+var kindNames = map[valueKind]string{
+	stringValue: "a string",
+	intValue:    "an integer",
+	boolValue:   "a boolean",
+	arrayValue:  "an array",
+	tableValue:  "a table",
+}
+
+// A value is a decoded JSON or TOML value, along with the line it starts on.
+// Both formats are decoded into values so they can share a single validator.
+type value struct {
+	kind valueKind
+	line int
+
+	str   string
+	num   int64
+	b     bool
+	array []*value
+
+	keys   []string // The keys of a table, in the order they appear
+	fields map[string]*value
+}
+
+func newTable(line int) *value {
+	return &value{kind: tableValue, line: line, fields: make(map[string]*value)}
+}
+
+func (v *value) set(key string, val *value) {
+	if _, ok := v.fields[key]; !ok {
+		v.keys = append(v.keys, key)
+	}
+	v.fields[key] = val
+}
+
+// lineIndex converts byte offsets into line numbers.
+type lineIndex []int
+
+func newLineIndex(data []byte) lineIndex {
+	starts := lineIndex{0}
+	for i, c := range data {
+		if c == '\n' {
+			starts = append(starts, i+1)
+		}
+	}
+	return starts
+}
+
+func (li lineIndex) line(offset int64) int {
+	line := 1
+	for line < len(li) && int64(li[line]) <= offset {
+		line++
+	}
+	return line
+}
+
+// decodeJSON decodes data into a value tree.
+func decodeJSON(data []byte) (*value, error) {
+	lines := newLineIndex(data)
+	dec := json.NewDecoder(bytes.NewReader(data))
+	dec.UseNumber()
+
+	v, err := decodeJSONValue(dec, lines)
+	if err == nil {
+		if _, err = dec.Token(); err == io.EOF {
+			return v, nil
+		} else if err == nil {
+			err = &Error{Line: lines.line(dec.InputOffset() - 1), Msg: "unexpected data after the top-level value"}
+		}
+	}
+
+	switch e := err.(type) {
+	case *json.SyntaxError:
+		return nil, &Error{Line: lines.line(e.Offset), Msg: e.Error()}
+	case *Error:
+		return nil, e
+	}
+	if err == io.EOF || err == io.ErrUnexpectedEOF {
+		return nil, &Error{Line: len(lines), Msg: "unexpected end of JSON input"}
+	}
+	return nil, err
+}
+
+func decodeJSONValue(dec *json.Decoder, lines lineIndex) (*value, error) {
+	t, err := dec.Token()
+	if err != nil {
+		return nil, err
+	}
+	// The offset is just past the token, so back up onto its last byte.
+	line := lines.line(dec.InputOffset() - 1)
+
+	switch t := t.(type) {
+	case string:
+		return &value{kind: stringValue, line: line, str: t}, nil
+	case bool:
+		return &value{kind: boolValue, line: line, b: t}, nil
+	case json.Number:
+		n, err := strconv.ParseInt(string(t), 10, 64)
+		if err != nil {
+			return nil, &Error{Line: line, Msg: fmt.Sprintf("%s is not an integer", t)}
+		}
+		return &value{kind: intValue, line: line, num: n}, nil
+	case json.Delim:
+		if t == '[' {
+			v := &value{kind: arrayValue, line: line}
+			for dec.More() {
+				elem, err := decodeJSONValue(dec, lines)
+				if err != nil {
+					return nil, err
+				}
+				v.array = append(v.array, elem)
+			}
+			_, err := dec.Token()
+			return v, err
+		}
+
+		v := newTable(line)
+		for dec.More() {
+			key, err := dec.Token()
+			if err != nil {
+				return nil, err
+			}
+			keyLine := lines.line(dec.InputOffset() - 1)
+			if _, ok := v.fields[key.(string)]; ok {
+				return nil, &Error{Line: keyLine, Msg: fmt.Sprintf("duplicate key %q", key)}
+			}
+			elem, err := decodeJSONValue(dec, lines)
+			if err != nil {
+				return nil, err
+			}
+			v.set(key.(string), elem)
+		}
+		_, err := dec.Token()
+		return v, err
+	}
+	return nil, &Error{Line: line, Msg: "null is not allowed"}
+}
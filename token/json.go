@@ -0,0 +1,141 @@
+package token
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+)
+
+// The JSON encoding of tokens is part of the wire format described by ast/schema.json.
+
+var kindNames = map[int]string{
+	SingleToken:    "single",
+	OpenToken:      "open",
+	CloseToken:     "close",
+	SymmetricToken: "symmetric",
+}
+
+// MarshalJSON encodes s as a [start, end] pair.
+func (s Span) MarshalJSON() ([]byte, error) {
+	return json.Marshal([2]int{s.Start, s.End})
+}
+
+func (s *Span) UnmarshalJSON(data []byte) error {
+	var pair [2]int
+	if err := json.Unmarshal(data, &pair); err != nil {
+		return err
+	}
+	if pair[0] < 0 || pair[1] < pair[0] {
+		return fmt.Errorf("token: invalid span [%d, %d]", pair[0], pair[1])
+	}
+	s.Start, s.End = pair[0], pair[1]
+	return nil
+}
+
+type jsonToken struct {
+	Type string   `json:"type"`
+	Kind string   `json:"kind,omitempty"`
+	Name string   `json:"name,omitempty"`
+	Args []string `json:"args,omitempty"`
+	Text string   `json:"text,omitempty"`
+	Span *Span    `json:"span,omitempty"`
+}
+
+func spanPtr(s Span) *Span {
+	if s == (Span{}) {
+		return nil
+	}
+	return &s
+}
+
+func (tt *TextToken) MarshalJSON() ([]byte, error) {
+	return json.Marshal(jsonToken{Type: "text", Text: tt.body, Span: spanPtr(tt.Span)})
+}
+
+func (tt *TextToken) UnmarshalJSON(data []byte) error {
+	var jt jsonToken
+	if err := json.Unmarshal(data, &jt); err != nil {
+		return err
+	}
+	if jt.Type != "text" {
+		return fmt.Errorf("token: expected a text token, got %q", jt.Type)
+	}
+	tt.body = jt.Text
+	tt.Span = Span{}
+	if jt.Span != nil {
+		tt.Span = *jt.Span
+	}
+	return nil
+}
+
+func (tt *TagToken) MarshalJSON() ([]byte, error) {
+	kind, ok := kindNames[tt.Kind]
+	if !ok {
+		return nil, fmt.Errorf("token: unknown token kind %d", tt.Kind)
+	}
+	return json.Marshal(jsonToken{Type: "tag", Kind: kind, Name: tt.Name, Args: tt.Args, Span: spanPtr(tt.Span)})
+}
+
+func (tt *TagToken) UnmarshalJSON(data []byte) error {
+	var jt jsonToken
+	if err := json.Unmarshal(data, &jt); err != nil {
+		return err
+	}
+	if jt.Type != "tag" {
+		return fmt.Errorf("token: expected a tag token, got %q", jt.Type)
+	}
+
+	*tt = TagToken{Kind: -1, Name: jt.Name, Args: jt.Args}
+	for kind, name := range kindNames {
+		if name == jt.Kind {
+			tt.Kind = kind
+		}
+	}
+	if tt.Kind == -1 {
+		return fmt.Errorf("token: unknown token kind %q", jt.Kind)
+	}
+	if jt.Span != nil {
+		tt.Span = *jt.Span
+	}
+	return nil
+}
+
+// A List is a token stream that can be decoded from JSON. Text tokens are
+// decoded into *TextTokens and tag tokens into *TagTokens.
+type List []Token
+
+func (l *List) UnmarshalJSON(data []byte) error {
+	var raw []json.RawMessage
+	if err := json.Unmarshal(data, &raw); err != nil {
+		return err
+	}
+
+	ret := make(List, len(raw))
+	for i, r := range raw {
+		var header struct {
+			Type string `json:"type"`
+		}
+		if err := json.Unmarshal(r, &header); err != nil {
+			return err
+		}
+
+		var t interface {
+			Token
+			json.Unmarshaler
+		}
+		switch header.Type {
+		case "text":
+			t = &TextToken{}
+		case "tag":
+			t = &TagToken{}
+		default:
+			return errors.New("token: unknown token type " + header.Type)
+		}
+		if err := t.UnmarshalJSON(r); err != nil {
+			return err
+		}
+		ret[i] = t
+	}
+	*l = ret
+	return nil
+}
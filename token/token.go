@@ -78,6 +78,8 @@ type Token interface {
 // i.e. "hi" in <p>hi</p>
 type TextToken struct {
 	body string
+
+	Span Span // Where the text came from in the input, if known
 }
 
 func NewTextToken(body string) *TextToken {
@@ -96,3 +98,26 @@ func (tt *TextToken) Output() (string, error) {
 func (tt *TextToken) Type() string {
 	return "TEXT"
 }
+
+// A TagToken is returned by matchers that produce markup, i.e. a BBCode tag.
+// Open and close TagTokens with the same Name surround the tokens of the tag's body.
+type TagToken struct {
+	Kind int      // One of SingleToken, OpenToken or CloseToken
+	Name string   // The name of the tag
+	Args []string // The tag's arguments; only set on SingleToken and OpenToken tokens
+	Span Span     // Where the tag came from in the input, if known
+}
+
+func NewTagToken(kind int, name string, args []string) *TagToken {
+	return &TagToken{Kind: kind, Name: name, Args: args}
+}
+
+func (tt *TagToken) Type() string {
+	return "TAG"
+}
+
+// A Span is the range of bytes [Start, End) of the input that a token or node came from.
+type Span struct {
+	Start int
+	End   int
+}